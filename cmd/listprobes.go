@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/usdt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// listProbesCmd lists the USDT probes of a process or binary, to help write probe configs
+var listProbesCmd = &cobra.Command{
+	Use:   "list-probes",
+	Short: "Lists the USDT probes built into a process or binary",
+	Long: `Lists the USDT probes built into a running process (--pid), including those of the libraries it has loaded,
+or into a binary or library (--binary), along with their locations, semaphores and arguments`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pid, _ := cmd.Flags().GetInt("pid")
+		binary, _ := cmd.Flags().GetString("binary")
+		output, _ := cmd.Flags().GetString("output")
+		if pid < 0 {
+			return fmt.Errorf("Invalid pid %d", pid)
+		}
+		if (pid == 0) == (binary == "") {
+			return fmt.Errorf("Exactly one of --pid and --binary must be given")
+		}
+		if output != "table" && output != "json" {
+			return fmt.Errorf("Unknown output format %q, must be table or json", output)
+		}
+		var context *usdt.Context
+		var err error
+		if pid != 0 {
+			context, err = usdt.NewContext(pid)
+		} else {
+			context, err = usdt.NewContextFromPath(binary)
+		}
+		if err != nil {
+			return err
+		}
+		defer context.Close()
+		probes, err := context.Probes()
+		if err != nil {
+			return err
+		}
+		return writeProbes(os.Stdout, probes, output)
+	},
+}
+
+// writeProbes writes the probes in the output format, either table or json
+func writeProbes(out io.Writer, probes []usdt.Probe, output string) error {
+	if output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(probes)
+	}
+	return printProbes(out, probes)
+}
+
+// printProbes writes the probes as a table, one row per probe. Since the arguments are
+// usually read the same way at every location, only those of the first one are shown.
+func printProbes(out io.Writer, probes []usdt.Probe) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVIDER\tNAME\tLOCATIONS\tSEMAPHORE\tARGUMENTS\tBINARY")
+	for _, probe := range probes {
+		semaphore := "-"
+		if probe.Semaphore != 0 {
+			semaphore = fmt.Sprintf("0x%x", probe.Semaphore)
+		}
+		arguments := "-"
+		if len(probe.Locations) > 0 && len(probe.Locations[0].Arguments) > 0 {
+			arguments = strings.Join(probe.Locations[0].Arguments, " ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", probe.Provider, probe.Name, len(probe.Locations), semaphore, arguments, probe.BinaryPath)
+	}
+	return w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(listProbesCmd)
+
+	listProbesCmd.Flags().IntP("pid", "p", 0, "The process whose probes, and those of its loaded libraries, are listed")
+	listProbesCmd.Flags().StringP("binary", "b", "", "The binary or library whose probes are listed")
+	listProbesCmd.Flags().StringP("output", "o", "table", "The output format, either table or json")
+}
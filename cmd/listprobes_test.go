@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"bytes"
+	"flag"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/usdt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// fixtureProbes returns the probes of the USDT fixture, as bcc would report them for the binary
+func fixtureProbes(t *testing.T) []usdt.Probe {
+	path := "../pkg/usdt/testdata/probes-x86_64"
+	notes, err := usdt.ReadNotes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probes := []usdt.Probe{}
+	for _, note := range notes {
+		location := usdt.Location{Address: note.PC, BinaryPath: path, Arguments: []string{}}
+		for _, arg := range note.Arguments {
+			location.Arguments = append(location.Arguments, arg.Spec)
+		}
+		probes = append(probes, usdt.Probe{
+			Provider:   note.Provider,
+			Name:       note.Name,
+			BinaryPath: path,
+			Semaphore:  note.Semaphore,
+			Locations:  []usdt.Location{location},
+		})
+	}
+	return probes
+}
+
+func TestWriteProbes(t *testing.T) {
+	probes := fixtureProbes(t)
+	for _, test := range []struct {
+		output string
+		golden string
+	}{
+		{output: "table", golden: "testdata/list-probes.golden.txt"},
+		{output: "json", golden: "testdata/list-probes.golden.json"},
+	} {
+		t.Run(test.output, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := writeProbes(&out, probes, test.output); err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := ioutil.WriteFile(test.golden, out.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := ioutil.ReadFile(test.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != string(golden) {
+				t.Errorf("Output doesn't match %s, run the test with -update if the change is intended:\n%s", test.golden, out.String())
+			}
+		})
+	}
+}
+
+func TestListProbesRejectsNegativePid(t *testing.T) {
+	if err := listProbesCmd.Flags().Set("pid", "-1"); err != nil {
+		t.Fatal(err)
+	}
+	defer listProbesCmd.Flags().Set("pid", "0")
+	err := listProbesCmd.RunE(listProbesCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "Invalid pid -1") {
+		t.Errorf("Expected a negative pid to be rejected, got %v", err)
+	}
+}
@@ -31,8 +31,7 @@ import (
 	"github.com/josecv/ebpf-userspace-exporter/pkg/server"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
-	yaml "gopkg.in/yaml.v2"
-	"io/ioutil"
+	"time"
 )
 
 var cfgFile string
@@ -48,16 +47,23 @@ var rootCmd = &cobra.Command{
 		configPath := viper.GetString("probe-config")
 		listenAddr := viper.GetString("listen-address")
 		metricsPath := viper.GetString("metrics-path")
-		yamlFile, err := ioutil.ReadFile(configPath)
-		if err != nil {
-			return fmt.Errorf("Error reading %s: %w", configPath, err)
+		discoveryInterval := viper.GetDuration("discovery-interval")
+		if discoveryInterval <= 0 {
+			return fmt.Errorf("Discovery interval must be positive, got %s", discoveryInterval)
 		}
-		config := config.Config{}
-		err = yaml.Unmarshal(yamlFile, &config)
+		config, err := config.Load(configPath)
 		if err != nil {
-			return fmt.Errorf("Error unmarshaling %s: %w", configPath, err)
+			return err
+		}
+		options := server.Options{
+			ListenAddr:        listenAddr,
+			MetricsPath:       metricsPath,
+			DiscoveryInterval: discoveryInterval,
+			ProcessEvents:     viper.GetBool("process-events"),
+			ConfigPath:        configPath,
+			WatchConfig:       viper.GetBool("watch-probe-config"),
 		}
-		server.Serve(listenAddr, metricsPath, config)
+		server.Serve(options, config)
 		// Should not be reached
 		return nil
 	},
@@ -87,6 +93,15 @@ func init() {
 
 	rootCmd.Flags().StringP("metrics-path", "m", "/metrics", "Path under which to serve metrics")
 	viper.BindPFlag("metrics-path", rootCmd.Flags().Lookup("metrics-path"))
+
+	rootCmd.Flags().DurationP("discovery-interval", "i", 10*time.Second, "How often to rescan running processes for new ones to attach programs to")
+	viper.BindPFlag("discovery-interval", rootCmd.Flags().Lookup("discovery-interval"))
+
+	rootCmd.Flags().Bool("process-events", true, "Track processes as they start and exit through the netlink proc connector, falling back to rescanning if it is unavailable")
+	viper.BindPFlag("process-events", rootCmd.Flags().Lookup("process-events"))
+
+	rootCmd.Flags().Bool("watch-probe-config", false, "Reload the probe config whenever its file changes, as well as on SIGHUP and on POST /-/reload")
+	viper.BindPFlag("watch-probe-config", rootCmd.Flags().Lookup("watch-probe-config"))
 }
 
 // initConfig reads in config file and ENV variables if set.
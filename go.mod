@@ -6,12 +6,15 @@ replace github.com/iovisor/gobpf => github.com/josecv/gobpf v0.0.0-2021030900195
 
 require (
 	github.com/cloudflare/ebpf_exporter v1.2.3
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/iovisor/gobpf v0.0.0-20200614202714-e6b321d32103
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/prometheus/client_golang v1.8.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/procfs v0.2.0
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/viper v1.7.0
 	go.uber.org/zap v1.13.0
+	golang.org/x/arch v0.3.0
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -1,15 +1,167 @@
 package config
 
-import ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+import (
+	"fmt"
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	yaml "gopkg.in/yaml.v2"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
 
 // Config describes the configuration of the entire sidecar
 type Config struct {
 	Programs []Program `yaml:"programs"`
 }
 
-// Attachment describes a program to attach to
+// Load reads the config from the yaml file at path
+func Load(path string) (Config, error) {
+	yamlFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("Error reading %s: %w", path, err)
+	}
+	config := Config{}
+	err = yaml.Unmarshal(yamlFile, &config)
+	if err != nil {
+		return Config{}, fmt.Errorf("Error unmarshaling %s: %w", path, err)
+	}
+	for i := range config.Programs {
+		if err := config.Programs[i].expandUSDTMetrics(); err != nil {
+			return Config{}, fmt.Errorf("Invalid usdt_metrics in program %s: %w", config.Programs[i].Name, err)
+		}
+		if err := config.Programs[i].validatePidLabels(); err != nil {
+			return Config{}, fmt.Errorf("Invalid metrics in program %s: %w", config.Programs[i].Name, err)
+		}
+	}
+	return config, nil
+}
+
+// Attachment describes a program to attach to.
+// A process must match every selector that is set in order to be attached to, as well as
+// every attachment in All and at least one attachment in Any (if there are any), and must
+// not match any attachment in Exclude.
+// Alternatively, Path attaches the program to every process, in which case it must be the
+// only field set.
 type Attachment struct {
+	// Path is the executable or library, as seen by the exporter, whose uprobes are attached
+	// for every process that runs it, current and future, without looking for processes
+	Path string `yaml:"path"`
+	// BinaryName is compared against /proc/PID/comm
 	BinaryName string `yaml:"binary_name"`
+	// CmdlineRegex is matched against /proc/PID/cmdline, with arguments joined by spaces
+	CmdlineRegex string `yaml:"cmdline_regex"`
+	// ExecutablePath is a glob matched against the executable the process is running,
+	// as seen from the process's own mount namespace
+	ExecutablePath string `yaml:"executable_path"`
+	// Cgroup is either a cgroup path prefix (when it starts with a /) or a container ID,
+	// matched against the cgroups in /proc/PID/cgroup
+	Cgroup string `yaml:"cgroup"`
+	// ParentBinaryName is compared against /proc/PPID/comm of the process's parent
+	ParentBinaryName string `yaml:"parent_binary_name"`
+	// OnlyRoot only keeps the matching processes whose parent doesn't match as well,
+	// e.g. the master of a pre-forking server
+	OnlyRoot bool `yaml:"only_root"`
+	// OnlyLeaf only keeps the matching processes that have no matching children,
+	// e.g. the workers of a pre-forking server
+	OnlyLeaf bool `yaml:"only_leaf"`
+	// PidFile is the path to a file holding the pid of the process, which is re-read
+	// whenever it changes and on every scan so that restarts are followed
+	PidFile string `yaml:"pid_file"`
+	// Env holds environment variables the process must have been started with,
+	// from /proc/PID/environ, mapped to their exact values
+	Env map[string]string `yaml:"env"`
+	// EnvRegex holds environment variables the process must have been started with,
+	// mapped to regular expressions their values must match
+	EnvRegex map[string]string `yaml:"env_regex"`
+	// UID is compared against the effective uid of the process
+	UID *int `yaml:"uid"`
+	// All holds nested attachments which must all match
+	All []Attachment `yaml:"all"`
+	// Any holds nested attachments of which at least one must match
+	Any []Attachment `yaml:"any"`
+	// Exclude holds nested attachments none of which may match
+	Exclude []Attachment `yaml:"exclude"`
+}
+
+// String describes the attachment's selectors, for use in logs and errors
+func (a Attachment) String() string {
+	selectors := []string{}
+	if a.Path != "" {
+		selectors = append(selectors, fmt.Sprintf("path=%q", a.Path))
+	}
+	if a.BinaryName != "" {
+		selectors = append(selectors, fmt.Sprintf("binary_name=%q", a.BinaryName))
+	}
+	if a.CmdlineRegex != "" {
+		selectors = append(selectors, fmt.Sprintf("cmdline_regex=%q", a.CmdlineRegex))
+	}
+	if a.ExecutablePath != "" {
+		selectors = append(selectors, fmt.Sprintf("executable_path=%q", a.ExecutablePath))
+	}
+	if a.Cgroup != "" {
+		selectors = append(selectors, fmt.Sprintf("cgroup=%q", a.Cgroup))
+	}
+	if a.PidFile != "" {
+		selectors = append(selectors, fmt.Sprintf("pid_file=%q", a.PidFile))
+	}
+	if a.ParentBinaryName != "" {
+		selectors = append(selectors, fmt.Sprintf("parent_binary_name=%q", a.ParentBinaryName))
+	}
+	if a.OnlyRoot {
+		selectors = append(selectors, "only_root")
+	}
+	if a.OnlyLeaf {
+		selectors = append(selectors, "only_leaf")
+	}
+	if len(a.Env) > 0 {
+		selectors = append(selectors, fmt.Sprintf("env=%s", mapString(a.Env)))
+	}
+	if len(a.EnvRegex) > 0 {
+		selectors = append(selectors, fmt.Sprintf("env_regex=%s", mapString(a.EnvRegex)))
+	}
+	if a.UID != nil {
+		selectors = append(selectors, fmt.Sprintf("uid=%d", *a.UID))
+	}
+	if len(a.All) > 0 {
+		selectors = append(selectors, fmt.Sprintf("all=%s", nestedString(a.All)))
+	}
+	if len(a.Any) > 0 {
+		selectors = append(selectors, fmt.Sprintf("any=%s", nestedString(a.Any)))
+	}
+	if len(a.Exclude) > 0 {
+		selectors = append(selectors, fmt.Sprintf("exclude=%s", nestedString(a.Exclude)))
+	}
+	return strings.Join(selectors, " ")
+}
+
+// FiltersTree returns whether the attachment narrows down processes by the process tree
+// they form, so that whether one process matches depends on every other matching process
+func (a Attachment) FiltersTree() bool {
+	return a.OnlyRoot || a.OnlyLeaf
+}
+
+// nestedString describes a list of nested attachments
+func nestedString(attachments []Attachment) string {
+	described := []string{}
+	for _, attachment := range attachments {
+		described = append(described, "{"+attachment.String()+"}")
+	}
+	return "[" + strings.Join(described, ", ") + "]"
+}
+
+// mapString describes a map of strings, sorted by key
+func mapString(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", key, m[key]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
 }
 
 // Program describes an eBPF program
@@ -18,5 +170,113 @@ type Program struct {
 	USDT                map[string]string `yaml:"usdt"`
 	Uprobes             map[string]string `yaml:"uprobes"`
 	Uretprobes          map[string]string `yaml:"uretprobes"`
-	Attachment          Attachment        `yaml:"attachment"`
+	// GoUretprobes emulates uretprobes on functions of Go programs, by attaching uprobes to
+	// every return instruction of each function instead
+	GoUretprobes map[string]string `yaml:"go_uretprobes"`
+	// USDTMetrics are counters read from usdt probe arguments, whose code is generated
+	USDTMetrics []USDTMetric `yaml:"usdt_metrics"`
+	Attachment  Attachment   `yaml:"attachment"`
+	// Required makes the exporter fail to start if no process matches the attachment,
+	// instead of waiting for one to appear
+	Required bool `yaml:"required"`
+	// Retry describes how attaching to a process is retried after failing
+	Retry Retry `yaml:"retry"`
+	// SharedModule compiles the program once and attaches it to every matching process,
+	// instead of compiling it for each one. Its maps are shared by every process, so
+	// every metric must have a pid label in their keys.
+	// Programs with usdt probes can only share a module when attached by path.
+	SharedModule bool `yaml:"shared_module"`
+	// MaxProbeSymbols caps how many symbols a uprobe or uretprobe given as a pattern may match
+	MaxProbeSymbols int `yaml:"max_probe_symbols"`
+}
+
+// PidLabel is the label that tells processes apart in the maps of a program with a shared module
+const PidLabel = "pid"
+
+// validatePidLabels checks that every metric of a program with a shared module has a pid label,
+// since its maps hold every process and the exporter can't tell them apart otherwise
+func (p Program) validatePidLabels() error {
+	if !p.UsesSharedModule() {
+		return nil
+	}
+	hasPid := func(labels []ebpf_config.Label) bool {
+		for _, label := range labels {
+			if label.Name == PidLabel {
+				return true
+			}
+		}
+		return false
+	}
+	for _, counter := range p.Metrics.Counters {
+		if !hasPid(counter.Labels) {
+			return fmt.Errorf("Counter %s has no %s label, which a program with a shared module must put in its keys", counter.Name, PidLabel)
+		}
+	}
+	for _, histogram := range p.Metrics.Histograms {
+		if !hasPid(histogram.Labels) {
+			return fmt.Errorf("Histogram %s has no %s label, which a program with a shared module must put in its keys", histogram.Name, PidLabel)
+		}
+	}
+	return nil
+}
+
+// DefaultMaxProbeSymbols is how many symbols a probe pattern may match, unless the program says otherwise
+const DefaultMaxProbeSymbols = 100
+
+// UsesSharedModule returns whether the program is compiled once for every process, either
+// because it asked to be or because it's attached by path
+func (p Program) UsesSharedModule() bool {
+	return p.SharedModule || p.Attachment.Path != ""
+}
+
+// ProbeSymbolLimit returns how many symbols a probe pattern may match
+func (p Program) ProbeSymbolLimit() int {
+	if p.MaxProbeSymbols <= 0 {
+		return DefaultMaxProbeSymbols
+	}
+	return p.MaxProbeSymbols
+}
+
+// Retry describes how attaching a program to a process is retried after failing,
+// backing off exponentially between attempts
+type Retry struct {
+	// InitialBackoff is how long to wait after the first failed attempt
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	// MaxBackoff caps how long to wait between attempts
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// MaxAttempts is how many times attaching to a process is attempted before giving up
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+// Default retry settings, used for any setting left unset
+const (
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = time.Minute
+	DefaultMaxAttempts    = 5
+)
+
+// WithDefaults returns the retry settings with the defaults filled in for anything unset
+func (r Retry) WithDefaults() Retry {
+	if r.InitialBackoff <= 0 {
+		r.InitialBackoff = DefaultInitialBackoff
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = DefaultMaxBackoff
+	}
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = DefaultMaxAttempts
+	}
+	return r
+}
+
+// Backoff returns how long to wait after the given number of failed attempts
+func (r Retry) Backoff(failedAttempts int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 1; i < failedAttempts && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+	return backoff
 }
@@ -0,0 +1,131 @@
+package config
+
+import (
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePidLabels(t *testing.T) {
+	pid := ebpf_config.Label{Name: PidLabel, Size: 4}
+	gen := ebpf_config.Label{Name: "gen", Size: 4}
+	bucket := ebpf_config.Label{Name: "bucket", Size: 8}
+	program := func(attachment Attachment, sharedModule bool, counterLabels, histogramLabels []ebpf_config.Label) Program {
+		p := Program{Attachment: attachment, SharedModule: sharedModule}
+		p.Metrics.Counters = []ebpf_config.Counter{{Name: "calls", Labels: counterLabels}}
+		p.Metrics.Histograms = []ebpf_config.Histogram{{Name: "latency", Labels: histogramLabels}}
+		return p
+	}
+	byName := Attachment{BinaryName: "python"}
+	byPath := Attachment{Path: "/usr/bin/python"}
+	tests := []struct {
+		name    string
+		program Program
+		err     string
+	}{
+		{
+			name:    "module per process",
+			program: program(byName, false, []ebpf_config.Label{gen}, []ebpf_config.Label{bucket}),
+		},
+		{
+			name:    "shared module with pid labels",
+			program: program(byName, true, []ebpf_config.Label{gen, pid}, []ebpf_config.Label{pid, bucket}),
+		},
+		{
+			name:    "shared module counter without pid label",
+			program: program(byName, true, []ebpf_config.Label{gen}, []ebpf_config.Label{pid, bucket}),
+			err:     "Counter calls has no pid label",
+		},
+		{
+			name:    "shared module histogram without pid label",
+			program: program(byName, true, []ebpf_config.Label{pid}, []ebpf_config.Label{bucket}),
+			err:     "Histogram latency has no pid label",
+		},
+		{
+			name:    "attached by path without pid label",
+			program: program(byPath, false, []ebpf_config.Label{gen}, []ebpf_config.Label{pid, bucket}),
+			err:     "Counter calls has no pid label",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.program.validatePidLabels()
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestExpandUSDTMetricsSharedModule(t *testing.T) {
+	program := Program{
+		Attachment: Attachment{Path: "/usr/bin/redis-server"},
+		USDTMetrics: []USDTMetric{{
+			Probe:  "redis:command",
+			Name:   "redis_commands_total",
+			Labels: []USDTLabel{{Name: "db", Argument: 2}},
+		}},
+	}
+	if err := program.expandUSDTMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if err := program.validatePidLabels(); err != nil {
+		t.Errorf("Expected the generated metrics to have a pid label, got %s", err)
+	}
+	labels := program.Metrics.Counters[0].Labels
+	if last := labels[len(labels)-1]; last.Name != PidLabel || last.Size != 8 {
+		t.Errorf("Expected the last label to be an 8 byte pid, got %+v", last)
+	}
+	// The pid goes right after the 8 bytes of the db label
+	for _, expected := range []string{"u8 data[16];", "arg = bpf_get_current_pid_tgid() >> 32;", "__builtin_memcpy(&key.data[8], &arg, sizeof(arg));"} {
+		if !strings.Contains(program.Code, expected) {
+			t.Errorf("Expected the generated code to contain %q:\n%s", expected, program.Code)
+		}
+	}
+}
+
+func TestRetryWithDefaults(t *testing.T) {
+	defaults := Retry{InitialBackoff: DefaultInitialBackoff, MaxBackoff: DefaultMaxBackoff, MaxAttempts: DefaultMaxAttempts}
+	if retry := (Retry{}).WithDefaults(); retry != defaults {
+		t.Errorf("Expected %+v, got %+v", defaults, retry)
+	}
+	if retry := (Retry{InitialBackoff: -time.Second, MaxAttempts: -1}).WithDefaults(); retry != defaults {
+		t.Errorf("Expected negative settings to be replaced by %+v, got %+v", defaults, retry)
+	}
+	set := Retry{InitialBackoff: 2 * time.Second, MaxBackoff: time.Hour, MaxAttempts: 10}
+	if retry := set.WithDefaults(); retry != set {
+		t.Errorf("Expected settings to be kept, got %+v", retry)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	retry := Retry{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		failedAttempts int
+		expected       time.Duration
+	}{
+		{failedAttempts: 0, expected: time.Second},
+		{failedAttempts: 1, expected: time.Second},
+		{failedAttempts: 2, expected: 2 * time.Second},
+		{failedAttempts: 3, expected: 4 * time.Second},
+		{failedAttempts: 4, expected: 8 * time.Second},
+		// Capped at the maximum
+		{failedAttempts: 5, expected: 10 * time.Second},
+		{failedAttempts: 1000, expected: 10 * time.Second},
+	}
+	for _, test := range tests {
+		if backoff := retry.Backoff(test.failedAttempts); backoff != test.expected {
+			t.Errorf("Expected a backoff of %s after %d failed attempts, got %s", test.expected, test.failedAttempts, backoff)
+		}
+	}
+	if backoff := (Retry{InitialBackoff: time.Minute, MaxBackoff: time.Second}).Backoff(1); backoff != time.Second {
+		t.Errorf("Expected an initial backoff above the maximum to be capped, got %s", backoff)
+	}
+}
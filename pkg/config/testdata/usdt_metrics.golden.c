@@ -0,0 +1,55 @@
+#include <uapi/linux/ptrace.h>
+
+struct redis_command_bytes_total_key_t {
+	u8 data[24];
+};
+
+BPF_HASH(redis_command_bytes_total, struct redis_command_bytes_total_key_t, u64);
+
+int usdt_metrics_0(struct pt_regs *ctx) {
+	u64 arg;
+	u64 arg_u64 = 0;
+	u32 arg_u32 = 0;
+	u16 arg_u16 = 0;
+	u8 arg_u8 = 0;
+	{
+		struct redis_command_bytes_total_key_t key = {};
+		u64 value = 1;
+		arg = 0;
+		if (bpf_usdt_readarg(1, ctx, &arg_u64) == 0) {
+			arg = arg_u64;
+		} else if (bpf_usdt_readarg(1, ctx, &arg_u32) == 0) {
+			arg = arg_u32;
+		} else if (bpf_usdt_readarg(1, ctx, &arg_u16) == 0) {
+			arg = arg_u16;
+		} else if (bpf_usdt_readarg(1, ctx, &arg_u8) == 0) {
+			arg = arg_u8;
+		}
+		bpf_probe_read_user_str(&key.data[0], 16, (void *)arg);
+		arg = 0;
+		if (bpf_usdt_readarg(2, ctx, &arg_u64) == 0) {
+			arg = arg_u64;
+		} else if (bpf_usdt_readarg(2, ctx, &arg_u32) == 0) {
+			arg = arg_u32;
+		} else if (bpf_usdt_readarg(2, ctx, &arg_u16) == 0) {
+			arg = arg_u16;
+		} else if (bpf_usdt_readarg(2, ctx, &arg_u8) == 0) {
+			arg = arg_u8;
+		}
+		__builtin_memcpy(&key.data[16], &arg, sizeof(arg));
+		arg = 0;
+		if (bpf_usdt_readarg(3, ctx, &arg_u64) == 0) {
+			arg = arg_u64;
+		} else if (bpf_usdt_readarg(3, ctx, &arg_u32) == 0) {
+			arg = arg_u32;
+		} else if (bpf_usdt_readarg(3, ctx, &arg_u16) == 0) {
+			arg = arg_u16;
+		} else if (bpf_usdt_readarg(3, ctx, &arg_u8) == 0) {
+			arg = arg_u8;
+		}
+		value = arg;
+		redis_command_bytes_total.increment(key, value);
+	}
+	return 0;
+}
+
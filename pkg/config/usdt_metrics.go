@@ -0,0 +1,222 @@
+package config
+
+import (
+	"fmt"
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// USDTMetric is a counter whose labels and value are read from the arguments of a usdt probe,
+// without writing any eBPF code: the code, the probe and the counter are all generated
+type USDTMetric struct {
+	// Probe is the usdt probe that updates the counter, as provider:name or just name
+	Probe string `yaml:"probe"`
+	// Name is the name of the counter, which is also used for its table
+	Name   string      `yaml:"name"`
+	Help   string      `yaml:"help"`
+	Labels []USDTLabel `yaml:"labels"`
+	// ValueArgument is the argument added to the counter every time the probe fires, or 0
+	// to count how many times it fires
+	ValueArgument int `yaml:"value_argument"`
+}
+
+// USDTLabel is a label whose value is read from an argument of a usdt probe
+type USDTLabel struct {
+	Name string `yaml:"name"`
+	// Argument is the position of the argument, starting at 1
+	Argument int `yaml:"argument"`
+	// Type is either uint, for an integer of up to 8 bytes, or string, for a pointer to a
+	// NUL terminated string
+	Type string `yaml:"type"`
+	// Size is how many bytes of a string are kept, including its terminator
+	Size uint `yaml:"size"`
+	// Decoders are applied to the label's value after it has been decoded according to its type
+	Decoders []ebpf_config.Decoder `yaml:"decoders"`
+}
+
+// USDT label types
+const (
+	USDTLabelUint   = "uint"
+	USDTLabelString = "string"
+)
+
+// DefaultUSDTStringSize is how many bytes of a string label are kept, unless it says otherwise
+const DefaultUSDTStringSize = 64
+
+// maxUSDTArgument is the most arguments a usdt probe can have
+const maxUSDTArgument = 12
+
+// cIdentifier matches the metric names that can be used as table names in the generated code
+var cIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// withDefaults returns the label with the defaults filled in for anything unset
+func (l USDTLabel) withDefaults() USDTLabel {
+	if l.Type == "" {
+		l.Type = USDTLabelUint
+	}
+	if l.Type == USDTLabelString && l.Size == 0 {
+		l.Size = DefaultUSDTStringSize
+	}
+	if l.Type == USDTLabelUint {
+		// Integers are always kept as 8 bytes, whatever their size in the probe
+		l.Size = 8
+	}
+	return l
+}
+
+// validate checks that the metric can be generated
+func (m USDTMetric) validate() error {
+	if !cIdentifier.MatchString(m.Name) {
+		return fmt.Errorf("Metric name %q must only have letters, digits and underscores", m.Name)
+	}
+	if m.Probe == "" {
+		return fmt.Errorf("Metric %s has no probe", m.Name)
+	}
+	if len(m.Labels) == 0 {
+		return fmt.Errorf("Metric %s needs at least one label", m.Name)
+	}
+	if m.ValueArgument < 0 || m.ValueArgument > maxUSDTArgument {
+		return fmt.Errorf("Metric %s has value_argument %d, which must be at most %d, or 0 to count calls", m.Name, m.ValueArgument, maxUSDTArgument)
+	}
+	for _, label := range m.Labels {
+		label = label.withDefaults()
+		if label.Argument < 1 || label.Argument > maxUSDTArgument {
+			return fmt.Errorf("Label %s of metric %s has argument %d, which must be between 1 and %d", label.Name, m.Name, label.Argument, maxUSDTArgument)
+		}
+		if label.Type != USDTLabelUint && label.Type != USDTLabelString {
+			return fmt.Errorf("Label %s of metric %s has unknown type %q, must be %s or %s", label.Name, m.Name, label.Type, USDTLabelUint, USDTLabelString)
+		}
+	}
+	return nil
+}
+
+// counter returns the counter that exports the metric's table, with the pid as its last label if withPid is set
+func (m USDTMetric) counter(withPid bool) ebpf_config.Counter {
+	counter := ebpf_config.Counter{Name: m.Name, Help: m.Help, Table: m.Name}
+	for _, label := range m.Labels {
+		label = label.withDefaults()
+		decoders := append([]ebpf_config.Decoder{{Name: label.Type}}, label.Decoders...)
+		counter.Labels = append(counter.Labels, ebpf_config.Label{Name: label.Name, Size: label.Size, Decoders: decoders})
+	}
+	if withPid {
+		counter.Labels = append(counter.Labels, ebpf_config.Label{Name: PidLabel, Size: 8, Decoders: []ebpf_config.Decoder{{Name: USDTLabelUint}}})
+	}
+	return counter
+}
+
+// keySize returns the size of the metric's table keys, which hold every label one after the
+// other, followed by the pid if withPid is set
+func (m USDTMetric) keySize(withPid bool) uint {
+	size := uint(0)
+	for _, label := range m.Labels {
+		size += label.withDefaults().Size
+	}
+	if withPid {
+		size += 8
+	}
+	return size
+}
+
+// expandUSDTMetrics generates the code, the usdt probes and the counters for the program's
+// usdt metrics, adding them to any that were written by hand
+func (p *Program) expandUSDTMetrics() error {
+	if len(p.USDTMetrics) == 0 {
+		return nil
+	}
+	byProbe := map[string][]USDTMetric{}
+	names := map[string]bool{}
+	for _, counter := range p.Metrics.Counters {
+		names[counter.Name] = true
+	}
+	for _, histogram := range p.Metrics.Histograms {
+		names[histogram.Name] = true
+	}
+	for _, metric := range p.USDTMetrics {
+		if err := metric.validate(); err != nil {
+			return err
+		}
+		if names[metric.Name] {
+			return fmt.Errorf("Metric %s is defined more than once", metric.Name)
+		}
+		names[metric.Name] = true
+		if _, ok := p.USDT[metric.Probe]; ok {
+			return fmt.Errorf("Probe %s of metric %s already has a function in usdt", metric.Probe, metric.Name)
+		}
+		byProbe[metric.Probe] = append(byProbe[metric.Probe], metric)
+	}
+	probes := make([]string, 0, len(byProbe))
+	for probe := range byProbe {
+		probes = append(probes, probe)
+	}
+	sort.Strings(probes)
+
+	// A shared module's maps hold every process, so the pid has to be in their keys
+	withPid := p.UsesSharedModule()
+	var code strings.Builder
+	code.WriteString("#include <uapi/linux/ptrace.h>\n\n")
+	for _, metric := range p.USDTMetrics {
+		fmt.Fprintf(&code, "struct %s_key_t {\n\tu8 data[%d];\n};\n\n", metric.Name, metric.keySize(withPid))
+		fmt.Fprintf(&code, "BPF_HASH(%s, struct %s_key_t, u64);\n\n", metric.Name, metric.Name)
+		p.Metrics.Counters = append(p.Metrics.Counters, metric.counter(withPid))
+	}
+	usdt := make(map[string]string, len(p.USDT)+len(probes))
+	for probe, fnName := range p.USDT {
+		usdt[probe] = fnName
+	}
+	for i, probe := range probes {
+		fnName := fmt.Sprintf("usdt_metrics_%d", i)
+		writeUSDTMetricsFunction(&code, fnName, byProbe[probe], withPid)
+		usdt[probe] = fnName
+	}
+	p.USDT = usdt
+	p.Code = code.String() + p.Code
+	return nil
+}
+
+// writeUSDTMetricsFunction writes the function that updates the metrics every time their probe fires
+func writeUSDTMetricsFunction(code *strings.Builder, fnName string, metrics []USDTMetric, withPid bool) {
+	fmt.Fprintf(code, "int %s(struct pt_regs *ctx) {\n", fnName)
+	code.WriteString("\tu64 arg;\n\tu64 arg_u64 = 0;\n\tu32 arg_u32 = 0;\n\tu16 arg_u16 = 0;\n\tu8 arg_u8 = 0;\n")
+	for _, metric := range metrics {
+		fmt.Fprintf(code, "\t{\n\t\tstruct %s_key_t key = {};\n\t\tu64 value = 1;\n", metric.Name)
+		offset := uint(0)
+		for _, label := range metric.Labels {
+			label = label.withDefaults()
+			writeReadArgument(code, label.Argument)
+			if label.Type == USDTLabelString {
+				fmt.Fprintf(code, "\t\tbpf_probe_read_user_str(&key.data[%d], %d, (void *)arg);\n", offset, label.Size)
+			} else {
+				fmt.Fprintf(code, "\t\t__builtin_memcpy(&key.data[%d], &arg, sizeof(arg));\n", offset)
+			}
+			offset += label.Size
+		}
+		if withPid {
+			code.WriteString("\t\targ = bpf_get_current_pid_tgid() >> 32;\n")
+			fmt.Fprintf(code, "\t\t__builtin_memcpy(&key.data[%d], &arg, sizeof(arg));\n", offset)
+		}
+		if metric.ValueArgument > 0 {
+			writeReadArgument(code, metric.ValueArgument)
+			code.WriteString("\t\tvalue = arg;\n")
+		}
+		fmt.Fprintf(code, "\t\t%s.increment(key, value);\n\t}\n", metric.Name)
+	}
+	code.WriteString("\treturn 0;\n}\n\n")
+}
+
+// writeReadArgument writes code that reads the argument into arg, widened to 8 bytes.
+// bcc only reads an argument into a destination of the argument's exact size, which depends
+// on the binary, so every size is tried in turn.
+func writeReadArgument(code *strings.Builder, argument int) {
+	code.WriteString("\t\targ = 0;\n")
+	for i, size := range []int{64, 32, 16, 8} {
+		if i > 0 {
+			code.WriteString(" else ")
+		} else {
+			code.WriteString("\t\t")
+		}
+		fmt.Fprintf(code, "if (bpf_usdt_readarg(%d, ctx, &arg_u%d) == 0) {\n\t\t\targ = arg_u%d;\n\t\t}", argument, size, size)
+	}
+	code.WriteString("\n")
+}
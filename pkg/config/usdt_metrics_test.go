@@ -0,0 +1,115 @@
+package config
+
+import (
+	"flag"
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestExpandUSDTMetrics(t *testing.T) {
+	config, err := Load("testdata/usdt_metrics.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := config.Programs[0]
+	if *update {
+		if err := ioutil.WriteFile("testdata/usdt_metrics.golden.c", []byte(program.Code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile("testdata/usdt_metrics.golden.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.Code != string(golden) {
+		t.Errorf("Generated code doesn't match testdata/usdt_metrics.golden.c, run the test with -update if the change is intended:\n%s", program.Code)
+	}
+	// The key holds the string label's 16 bytes, then the uint label's 8
+	expectedCounters := []ebpf_config.Counter{{
+		Name:  "redis_command_bytes_total",
+		Help:  "Bytes read by command and database",
+		Table: "redis_command_bytes_total",
+		Labels: []ebpf_config.Label{
+			{Name: "command", Size: 16, Decoders: []ebpf_config.Decoder{{Name: "string"}}},
+			{Name: "db", Size: 8, Decoders: []ebpf_config.Decoder{{Name: "uint"}}},
+		},
+	}}
+	if !reflect.DeepEqual(program.Metrics.Counters, expectedCounters) {
+		t.Errorf("Expected counters %+v, got %+v", expectedCounters, program.Metrics.Counters)
+	}
+	if expected := map[string]string{"redis:command": "usdt_metrics_0"}; !reflect.DeepEqual(program.USDT, expected) {
+		t.Errorf("Expected usdt %v, got %v", expected, program.USDT)
+	}
+}
+
+func TestExpandUSDTMetricsErrors(t *testing.T) {
+	label := USDTLabel{Name: "label", Argument: 1}
+	metric := USDTMetric{Probe: "probe", Name: "calls", Labels: []USDTLabel{label}}
+	tests := []struct {
+		name    string
+		program Program
+		err     string
+	}{
+		{
+			name:    "duplicate usdt metrics",
+			program: Program{USDTMetrics: []USDTMetric{metric, metric}},
+			err:     "defined more than once",
+		},
+		{
+			name: "usdt metric named like a counter",
+			program: Program{
+				Program:     ebpf_config.Program{Metrics: ebpf_config.Metrics{Counters: []ebpf_config.Counter{{Name: "calls"}}}},
+				USDTMetrics: []USDTMetric{metric},
+			},
+			err: "defined more than once",
+		},
+		{
+			name:    "probe already in usdt",
+			program: Program{USDT: map[string]string{"probe": "trace_probe"}, USDTMetrics: []USDTMetric{metric}},
+			err:     "already has a function in usdt",
+		},
+		{
+			name:    "bad label type",
+			program: Program{USDTMetrics: []USDTMetric{{Probe: "probe", Name: "calls", Labels: []USDTLabel{{Name: "label", Argument: 1, Type: "float"}}}}},
+			err:     "unknown type",
+		},
+		{
+			name:    "name that isn't a C identifier",
+			program: Program{USDTMetrics: []USDTMetric{{Probe: "probe", Name: "calls-total", Labels: []USDTLabel{label}}}},
+			err:     "must only have",
+		},
+		{
+			name:    "no probe",
+			program: Program{USDTMetrics: []USDTMetric{{Name: "calls", Labels: []USDTLabel{label}}}},
+			err:     "has no probe",
+		},
+		{
+			name:    "no labels",
+			program: Program{USDTMetrics: []USDTMetric{{Probe: "probe", Name: "calls"}}},
+			err:     "at least one label",
+		},
+		{
+			name:    "label argument out of range",
+			program: Program{USDTMetrics: []USDTMetric{{Probe: "probe", Name: "calls", Labels: []USDTLabel{{Name: "label", Argument: 13}}}}},
+			err:     "must be between 1 and 12",
+		},
+		{
+			name:    "value argument out of range",
+			program: Program{USDTMetrics: []USDTMetric{{Probe: "probe", Name: "calls", Labels: []USDTLabel{label}, ValueArgument: -1}}},
+			err:     "value_argument",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.program.expandUSDTMetrics()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
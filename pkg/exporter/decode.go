@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"fmt"
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/uprobe"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+// usymDecoder turns an address in a process, as decoded by the uint decoder before it, into the
+// name of the symbol it's in. It's typically given the instruction pointer of a uprobe attached
+// to many symbols. It's handled here rather than by the decoder set, since it needs to know
+// which process the address is in, so it must be the last decoder of its label.
+const usymDecoder = "usym"
+
+// decodeLabels transforms eBPF map key bytes into a list of label values for the
+// module attached to pid, which is -1 for a shared module
+func (e *Exporter) decodeLabels(key []byte, labels []ebpf_config.Label, pid int) ([]string, error) {
+	decodable := make([]ebpf_config.Label, len(labels))
+	symbolized := []int{}
+	for i, label := range labels {
+		decodable[i] = label
+		last := len(label.Decoders) - 1
+		if last >= 0 && label.Decoders[last].Name == usymDecoder {
+			decodable[i].Decoders = label.Decoders[:last]
+			symbolized = append(symbolized, i)
+		}
+	}
+	values, err := e.decoders.DecodeLabels(key, decodable)
+	if err != nil || len(symbolized) == 0 {
+		return values, err
+	}
+	if pid == systemWidePid {
+		return nil, fmt.Errorf("The %s decoder can't be used by programs with a shared module", usymDecoder)
+	}
+	for _, i := range symbolized {
+		address, err := strconv.ParseUint(values[i], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("The %s decoder needs an address decoded by uint, got %q for label %s", usymDecoder, values[i], labels[i].Name)
+		}
+		values[i] = e.symbolize(pid, address)
+	}
+	return values, nil
+}
+
+// symbolize returns the name of the symbol the address in the process is in, or the address
+// itself if it can't be found
+func (e *Exporter) symbolize(pid int, address uint64) string {
+	e.symbolizersMu.Lock()
+	defer e.symbolizersMu.Unlock()
+	symbolizer, ok := e.symbolizers[pid]
+	if !ok {
+		var err error
+		symbolizer, err = uprobe.NewSymbolizer(pid)
+		if err != nil {
+			zap.S().Debugf("Unable to symbolize addresses in pid %d: %s", pid, err)
+			return fmt.Sprintf("0x%x", address)
+		}
+		e.symbolizers[pid] = symbolizer
+	}
+	symbol, err := symbolizer.Symbol(address)
+	if err != nil {
+		zap.S().Debugf("%s", err)
+		return fmt.Sprintf("0x%x", address)
+	}
+	return symbol
+}
+
+// closeSymbolizer releases the symbols loaded for the process, if any
+func (e *Exporter) closeSymbolizer(pid int) {
+	e.symbolizersMu.Lock()
+	defer e.symbolizersMu.Unlock()
+	if symbolizer, ok := e.symbolizers[pid]; ok {
+		symbolizer.Close()
+		delete(e.symbolizers, pid)
+	}
+}
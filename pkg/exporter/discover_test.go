@@ -0,0 +1,326 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/prometheus/procfs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProcs is a proc filesystem in a temporary directory, holding only what discovery reads
+type fakeProcs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeProcs(t *testing.T) *fakeProcs {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return &fakeProcs{t: t, root: root}
+}
+
+// start writes a process running comm, started at startTime
+func (f *fakeProcs) start(pid int, comm string, startTime int) {
+	dir := filepath.Join(f.root, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	stat := fmt.Sprintf("%d (%s) S 1 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 1 0 %d 0 0\n", pid, comm, startTime)
+	if err := ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// mapFile copies the source file into the process's root at path, or creates an empty file
+// there if there's no source, and maps it into the process
+func (f *fakeProcs) mapFile(pid int, path, source string) {
+	data := []byte{}
+	if source != "" {
+		var err error
+		data, err = ioutil.ReadFile(source)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(f.root, strconv.Itoa(pid))
+	target := filepath.Join(dir, "root", path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(target, data, 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	maps, err := os.OpenFile(filepath.Join(dir, "maps"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer maps.Close()
+	if _, err := fmt.Fprintf(maps, "00400000-00410000 r-xp 00000000 08:01 100 %s\n", path); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// exit removes the process
+func (f *fakeProcs) exit(pid int) {
+	if err := os.RemoveAll(filepath.Join(f.root, strconv.Itoa(pid))); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeProcs) finder() process.Finder {
+	finder, err := process.NewFinderAt(f.root)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return finder
+}
+
+// recorder replaces attaching and detaching with recording what would have been done
+type recorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *recorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.calls...)
+}
+
+// newTestExporter returns an exporter for the programs, or for a single program attached to
+// python processes if there are none, whose attachments are recorded instead of made
+func newTestExporter(programs ...config.Program) (*Exporter, *recorder) {
+	if len(programs) == 0 {
+		programs = []config.Program{newTestProgram("python")}
+	}
+	e := New(config.Config{Programs: programs})
+	r := &recorder{}
+	e.attachProc = func(program config.Program, proc procfs.Proc) error {
+		stat, err := proc.Stat()
+		if err != nil {
+			return err
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.modules[program.Name]; !ok {
+			e.modules[program.Name] = map[int]*bcc.Module{}
+		}
+		e.modules[program.Name][proc.PID] = nil
+		e.startTimes[proc.PID] = stat.Starttime
+		r.record(fmt.Sprintf("attach %s %d", program.Name, proc.PID))
+		return nil
+	}
+	e.detachProc = func(programName string, pid int) {
+		delete(e.modules[programName], pid)
+		r.record(fmt.Sprintf("detach %s %d", programName, pid))
+	}
+	return e, r
+}
+
+func newTestProgram(binaryName string) config.Program {
+	program := config.Program{Attachment: config.Attachment{BinaryName: binaryName}}
+	program.Name = binaryName
+	return program
+}
+
+// runDiscovery runs discovery until the test ends
+func runDiscovery(t *testing.T, e *Exporter, finder process.Finder, events <-chan process.Event, interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.discoverWith(finder, events, interval, stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+}
+
+// waitForCalls waits for the recorder to have recorded exactly the expected calls
+func waitForCalls(t *testing.T, r *recorder, expected ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		calls := r.recorded()
+		if reflect.DeepEqual(calls, expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected calls %v, got %v", expected, calls)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestForkAttaches(t *testing.T) {
+	procs := newFakeProcs(t)
+	e, r := newTestExporter()
+	source := process.NewFakeEventSource()
+	runDiscovery(t, e, procs.finder(), source.Events(), time.Hour)
+
+	procs.start(100, "bash", 1)
+	source.Send(process.Event{Type: process.Fork, PID: 100})
+	procs.start(101, "python", 1)
+	source.Send(process.Event{Type: process.Fork, PID: 101})
+	waitForCalls(t, r, "attach python 101")
+	if !e.isAttached("python", 101) || e.isAttached("python", 100) {
+		t.Errorf("Expected only pid 101 to be attached")
+	}
+}
+
+func TestExecReattaches(t *testing.T) {
+	procs := newFakeProcs(t)
+	e, r := newTestExporter()
+	source := process.NewFakeEventSource()
+	runDiscovery(t, e, procs.finder(), source.Events(), time.Hour)
+
+	procs.start(100, "python", 1)
+	source.Send(process.Event{Type: process.Fork, PID: 100})
+	// Executing python again replaces the image that was attached to
+	source.Send(process.Event{Type: process.Exec, PID: 100})
+	waitForCalls(t, r, "attach python 100", "detach python 100", "attach python 100")
+
+	// Executing something else leaves nothing to attach to
+	procs.start(100, "bash", 1)
+	source.Send(process.Event{Type: process.Exec, PID: 100})
+	waitForCalls(t, r, "attach python 100", "detach python 100", "attach python 100", "detach python 100")
+	if e.isAttached("python", 100) {
+		t.Errorf("Expected pid 100 to be detached after executing bash")
+	}
+}
+
+func TestExitDetaches(t *testing.T) {
+	procs := newFakeProcs(t)
+	e, r := newTestExporter()
+	source := process.NewFakeEventSource()
+	runDiscovery(t, e, procs.finder(), source.Events(), time.Hour)
+
+	procs.start(100, "python", 1)
+	source.Send(process.Event{Type: process.Fork, PID: 100})
+	// The process has to still be there when the fork is handled for anything to be attached
+	waitForCalls(t, r, "attach python 100")
+	procs.exit(100)
+	source.Send(process.Event{Type: process.Exit, PID: 100})
+	waitForCalls(t, r, "attach python 100", "detach python 100")
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if _, ok := e.startTimes[100]; ok {
+		t.Errorf("Expected the start time of pid 100 to be forgotten")
+	}
+}
+
+func TestRescansWhenEventsClose(t *testing.T) {
+	procs := newFakeProcs(t)
+	e, r := newTestExporter()
+	source := process.NewFakeEventSource()
+	runDiscovery(t, e, procs.finder(), source.Events(), 10*time.Millisecond)
+
+	source.Close()
+	procs.start(100, "python", 1)
+	waitForCalls(t, r, "attach python 100")
+	// A rescan also notices the process exiting, with no event to say so
+	procs.exit(100)
+	waitForCalls(t, r, "attach python 100", "detach python 100")
+}
+
+func TestTreeFiltersWaitForRescan(t *testing.T) {
+	procs := newFakeProcs(t)
+	leaf := newTestProgram("python")
+	leaf.Name = "python_leaf"
+	leaf.Attachment.OnlyLeaf = true
+	e, r := newTestExporter(newTestProgram("python"), leaf)
+	source := process.NewFakeEventSource()
+	runDiscovery(t, e, procs.finder(), source.Events(), time.Hour)
+
+	procs.start(100, "python", 1)
+	source.Send(process.Event{Type: process.Fork, PID: 100})
+	waitForCalls(t, r, "attach python 100")
+	e.discover(procs.finder())
+	waitForCalls(t, r, "attach python 100", "attach python_leaf 100")
+}
+
+func TestFollowsPidFile(t *testing.T) {
+	procs := newFakeProcs(t)
+	pidFile := filepath.Join(procs.root, "app.pid")
+	program := config.Program{Attachment: config.Attachment{PidFile: pidFile}}
+	program.Name = "app"
+	e, r := newTestExporter(program)
+	procs.start(100, "python", 1)
+	procs.start(101, "python", 1)
+	if err := ioutil.WriteFile(pidFile, []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.discover(procs.finder())
+	waitForCalls(t, r, "attach app 100")
+	runDiscovery(t, e, procs.finder(), nil, time.Hour)
+
+	// The old process is still running, but the file no longer names it. The file is rewritten
+	// until discovery notices, since it may not be watching yet.
+	expected := []string{"attach app 100", "detach app 100", "attach app 101"}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(r.recorded(), expected) && time.Now().Before(deadline) {
+		if err := ioutil.WriteFile(pidFile, []byte("101\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitForCalls(t, r, expected...)
+	if e.isAttached("app", 100) {
+		t.Errorf("Expected pid 100 to be detached")
+	}
+}
+
+func TestMissingPidFileIsStale(t *testing.T) {
+	procs := newFakeProcs(t)
+	pidFile := filepath.Join(procs.root, "app.pid")
+	program := config.Program{Attachment: config.Attachment{PidFile: pidFile}}
+	program.Name = "app"
+	e, _ := newTestExporter(program)
+	procs.start(100, "python", 1)
+
+	isStale := func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.stalePidFiles["app"]
+	}
+	e.discover(procs.finder())
+	if !isStale() {
+		t.Errorf("Expected a missing pid file to be stale")
+	}
+	if err := ioutil.WriteFile(pidFile, []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.discover(procs.finder())
+	if isStale() {
+		t.Errorf("Expected a pid file naming a running process not to be stale")
+	}
+	if err := ioutil.WriteFile(pidFile, []byte("not a pid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.discover(procs.finder())
+	if !isStale() {
+		t.Errorf("Expected an invalid pid file to be stale")
+	}
+}
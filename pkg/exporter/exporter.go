@@ -1,18 +1,25 @@
 package exporter
 
 import (
+	"errors"
 	"fmt"
 	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
 	"github.com/cloudflare/ebpf_exporter/decoder"
 	"github.com/iovisor/gobpf/bcc"
 	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
 	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/uprobe"
 	"github.com/josecv/ebpf-userspace-exporter/pkg/usdt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/procfs"
 	"go.uber.org/zap"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // This file is taken almost verbatim from cloudflare/ebpf_exporter at https://github.com/cloudflare/ebpf_exporter/blob/master/exporter/exporter.go
@@ -23,13 +30,53 @@ const prometheusNamespace = "userspace_exporter"
 
 // Exporter is the metrics exporter itself
 type Exporter struct {
-	config              config.Config
-	modules             map[string]map[int]*bcc.Module
-	usdtContexts        map[string]map[int]*usdt.Context
-	ksyms               map[uint64]string
-	enabledProgramsDesc *prometheus.Desc
-	descs               map[string]map[string]*prometheus.Desc
-	decoders            *decoder.Set
+	config config.Config
+	// attachMu serializes attaching programs, so that the discovery loop and
+	// the initial attachment never race each other
+	attachMu sync.Mutex
+	// mu guards the config, the descs, and modules, sharedModules, sharedProbes, usdtContexts,
+	// missingProbes, startTimes, stalePidFiles and retries, all of which are read concurrently by Collect
+	mu           sync.RWMutex
+	modules      map[string]map[int]*bcc.Module
+	usdtContexts map[string]map[int]*usdt.Context
+	// sharedModules holds the single module of every program with a shared module. The
+	// module is also in modules for every pid it's attached to, but it's kept until the
+	// program itself is detached, even if no process is attached to it anymore.
+	sharedModules map[string]*bcc.Module
+	// sharedProbes holds the uprobes attached to each pid for programs with a shared module,
+	// so that they can be detached from a single process
+	sharedProbes map[string]map[int][]detachable
+	// missingProbes holds the usdt probes that weren't available in each process a program
+	// was attached to, since they may be in a library the process loads later
+	missingProbes map[string]map[int]*missingProbes
+	// startTimes holds the start time of every attached pid, so that a pid that
+	// has been reused by a new process isn't mistaken for the one we attached to
+	startTimes map[int]uint64
+	// stalePidFiles holds, for every program attached through a pid file, whether the file
+	// was missing, unreadable or pointed at a process that isn't running the last time it was read
+	stalePidFiles map[string]bool
+	// retries holds the retry state of every process a program failed to be attached to
+	retries map[string]map[int]*retryState
+	// symbolizersMu guards symbolizers, which are created lazily by Collect
+	symbolizersMu sync.Mutex
+	// symbolizers holds the symbols loaded for every pid whose metrics have a usym label
+	symbolizers                map[int]*uprobe.Symbolizer
+	ksyms                      map[uint64]string
+	enabledProgramsDesc        *prometheus.Desc
+	pendingProgramsDesc        *prometheus.Desc
+	stalePidFileDesc           *prometheus.Desc
+	attachErrors               *prometheus.CounterVec
+	attachFailedAttemptsDesc   *prometheus.Desc
+	attachRetriesExhaustedDesc *prometheus.Desc
+	compileDuration            *prometheus.HistogramVec
+	descs                      map[string]map[string]*prometheus.Desc
+	decoders                   *decoder.Set
+	// attachProc attaches a program to a process, and detachProc detaches it again with mu
+	// held. They're only replaced in tests, so that discovery can run without bcc.
+	attachProc func(program config.Program, proc procfs.Proc) error
+	detachProc func(programName string, pid int)
+	// uprobeAttacher attaches the uprobes of shared modules
+	uprobeAttacher uprobeAttacher
 }
 
 // New creates a new exporter with the provided config
@@ -41,55 +88,485 @@ func New(config config.Config) *Exporter {
 		nil,
 	)
 
-	return &Exporter{
-		config:              config,
-		modules:             map[string]map[int]*bcc.Module{},
-		usdtContexts:        map[string]map[int]*usdt.Context{},
-		ksyms:               map[uint64]string{},
-		enabledProgramsDesc: enabledProgramsDesc,
-		descs:               map[string]map[string]*prometheus.Desc{},
-		decoders:            decoder.NewSet(),
+	pendingProgramsDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(prometheusNamespace, "", "pending_programs"),
+		"The set of programs not attached to any process yet",
+		[]string{"name"},
+		nil,
+	)
+
+	stalePidFileDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(prometheusNamespace, "", "pid_file_stale"),
+		"Whether the pid file of a program is missing, unreadable, or points at a process that is not running",
+		[]string{"name", "pid_file"},
+		nil,
+	)
+
+	attachErrors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "attach_errors_total",
+			Help:      "The number of times attaching a program to a process failed, by the stage it failed at",
+		},
+		[]string{"program", "pid", "stage"},
+	)
+
+	attachFailedAttemptsDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(prometheusNamespace, "", "attach_failed_attempts"),
+		"The number of failed attempts at attaching a program to a process it isn't attached to yet",
+		[]string{"program", "pid"},
+		nil,
+	)
+
+	attachRetriesExhaustedDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(prometheusNamespace, "", "attach_retries_exhausted"),
+		"Whether attaching a program to a process has been given up on after running out of attempts",
+		[]string{"program", "pid"},
+		nil,
+	)
+
+	compileDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "compile_duration_seconds",
+			Help:      "How long compiling a program took",
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 8),
+		},
+		[]string{"program"},
+	)
+
+	e := &Exporter{
+		config:                     config,
+		modules:                    map[string]map[int]*bcc.Module{},
+		usdtContexts:               map[string]map[int]*usdt.Context{},
+		sharedModules:              map[string]*bcc.Module{},
+		sharedProbes:               map[string]map[int][]detachable{},
+		missingProbes:              map[string]map[int]*missingProbes{},
+		startTimes:                 map[int]uint64{},
+		stalePidFiles:              map[string]bool{},
+		retries:                    map[string]map[int]*retryState{},
+		symbolizers:                map[int]*uprobe.Symbolizer{},
+		ksyms:                      map[uint64]string{},
+		enabledProgramsDesc:        enabledProgramsDesc,
+		pendingProgramsDesc:        pendingProgramsDesc,
+		stalePidFileDesc:           stalePidFileDesc,
+		attachErrors:               attachErrors,
+		attachFailedAttemptsDesc:   attachFailedAttemptsDesc,
+		attachRetriesExhaustedDesc: attachRetriesExhaustedDesc,
+		compileDuration:            compileDuration,
+		descs:                      map[string]map[string]*prometheus.Desc{},
+		decoders:                   decoder.NewSet(),
+		uprobeAttacher:             bccUprobeAttacher,
 	}
+	e.attachProc = e.attachProgramToProc
+	e.detachProc = e.detachLocked
+	e.buildDescsLocked()
+	return e
 }
 
-// Attach enables usdt probes, then attaches the corresponding uprobes
+// Attach enables usdt probes, then attaches the corresponding uprobes.
+// Programs that no process matches yet are left pending, to be attached by Discover once one
+// appears, unless they are required, in which case an error is returned.
 func (e *Exporter) Attach() error {
 	processFinder, err := process.NewFinder()
 	if err != nil {
 		return err
 	}
+	e.attachMu.Lock()
+	defer e.attachMu.Unlock()
 	for _, program := range e.config.Programs {
-		procs, err := processFinder.FindByBinaryName(program.Attachment.BinaryName)
-		if err != nil {
-			return fmt.Errorf("Error searching for process with binary %s for ebpf program %s: %w", program.Attachment.BinaryName, program.Name, err)
+		if err := e.attachProgram(processFinder, program); err != nil {
+			return err
 		}
-		if len(procs) == 0 {
-			return fmt.Errorf("No process for binary %s found (ebpf program %s)", program.Attachment.BinaryName, program.Name)
+	}
+	return nil
+}
+
+// attachProgram attaches the program to every process matching its attachment, returning
+// an error only if the program is required and couldn't be attached to any process
+func (e *Exporter) attachProgram(processFinder process.Finder, program config.Program) error {
+	if program.Attachment.Path != "" {
+		return e.attachProgramByPath(program)
+	}
+	procs, err := e.findProcs(processFinder, program)
+	if err != nil {
+		err = fmt.Errorf("Error searching for process with %s for ebpf program %s: %w", program.Attachment, program.Name, err)
+		if program.Required {
+			return err
 		}
-		for _, proc := range procs {
-			if err := e.attachProgramToProc(program, proc); err != nil {
-				return err
-			}
+		zap.S().Warnf("%s; the program will be pending until a process is found", err)
+		return nil
+	}
+	if len(procs) == 0 {
+		if program.Required {
+			return fmt.Errorf("No process with %s found (ebpf program %s)", program.Attachment, program.Name)
 		}
+		zap.S().Infof("No process with %s found yet; ebpf program %s is pending", program.Attachment, program.Name)
+		return nil
+	}
+	if attached := e.attachProgramToProcs(program, procs); attached == 0 && program.Required {
+		return fmt.Errorf("Unable to attach ebpf program %s to any process with %s", program.Name, program.Attachment)
 	}
 	return nil
 }
 
-func (e *Exporter) attachProbesToProc(probes map[string]string, proc procfs.Proc, loader func(string) (int, error), attacher func(string, string, int, int) error) error {
-	executablePath, err := proc.Executable()
+// Reload switches the exporter over to a new config. Programs that were removed are detached,
+// programs that were added are attached, and programs that changed are detached and attached
+// again, which recompiles them. Programs that didn't change are left untouched, so their maps
+// keep counting as if nothing happened.
+// Callers registering the exporter with prometheus must unregister it before reloading, and
+// register it again afterwards, since the metrics it describes may change.
+func (e *Exporter) Reload(newConfig config.Config) error {
+	processFinder, err := process.NewFinder()
+	if err != nil {
+		return err
+	}
+	e.attachMu.Lock()
+	defer e.attachMu.Unlock()
+	oldPrograms := map[string]config.Program{}
+	for _, program := range e.config.Programs {
+		oldPrograms[program.Name] = program
+	}
+	newPrograms := map[string]config.Program{}
+	for _, program := range newConfig.Programs {
+		newPrograms[program.Name] = program
+	}
+	for name, oldProgram := range oldPrograms {
+		newProgram, ok := newPrograms[name]
+		if !ok {
+			zap.S().Infof("Program %s was removed, detaching it", name)
+			e.detachProgram(name)
+		} else if !reflect.DeepEqual(oldProgram, newProgram) {
+			zap.S().Infof("Program %s changed, detaching it to attach it again", name)
+			e.detachProgram(name)
+		}
+	}
+	e.mu.Lock()
+	e.config = newConfig
+	// Collect may run before the exporter is described again, so it needs the new descs now
+	e.buildDescsLocked()
+	e.mu.Unlock()
+	for _, program := range newConfig.Programs {
+		oldProgram, ok := oldPrograms[program.Name]
+		if ok && reflect.DeepEqual(oldProgram, program) {
+			continue
+		}
+		if err := e.attachProgram(processFinder, program); err != nil {
+			zap.S().Errorf("Error attaching reloaded ebpf program %s: %s", program.Name, err)
+		}
+	}
+	return nil
+}
+
+// detachProgram detaches the named program from every process, and forgets everything about it
+func (e *Exporter) detachProgram(programName string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for pid := range e.modules[programName] {
+		e.detachLocked(programName, pid)
+	}
+	if module, ok := e.sharedModules[programName]; ok {
+		module.Close()
+	}
+	delete(e.usdtContexts, programName)
+	delete(e.modules, programName)
+	delete(e.sharedModules, programName)
+	delete(e.sharedProbes, programName)
+	delete(e.missingProbes, programName)
+	delete(e.retries, programName)
+	delete(e.stalePidFiles, programName)
+	delete(e.descs, programName)
+	for pid := range e.startTimes {
+		if !e.isAttachedToAnyLocked(pid) {
+			delete(e.startTimes, pid)
+		}
+	}
+}
+
+// Config returns the config the exporter is currently running with
+func (e *Exporter) Config() config.Config {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.config
+}
+
+// programs returns the programs in the current config
+func (e *Exporter) programs() []config.Program {
+	return e.Config().Programs
+}
+
+// isAttachedToAnyLocked returns whether any program is attached to the pid.
+// The caller must hold mu.
+func (e *Exporter) isAttachedToAnyLocked(pid int) bool {
+	for _, byPid := range e.modules {
+		if _, ok := byPid[pid]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Discover attaches programs to new processes matching their attachment, and detaches
+// them from processes that exit, as reported by events. Running processes are also
+// rescanned every interval to catch up on anything the events missed; if events is nil,
+// or is closed, rescanning is the only way processes are discovered.
+// It blocks until stop is closed.
+func (e *Exporter) Discover(events <-chan process.Event, interval time.Duration, stop <-chan struct{}) {
+	processFinder, err := process.NewFinder()
+	if err != nil {
+		zap.S().Errorf("Unable to start process discovery: %s", err)
+		return
+	}
+	e.discoverWith(processFinder, events, interval, stop)
+}
+
+// discoverWith runs Discover with the given process finder
+func (e *Exporter) discoverWith(processFinder process.Finder, events <-chan process.Event, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	retryTicker := time.NewTicker(retryCheckInterval)
+	defer retryTicker.Stop()
+	pidFiles := newPidFileWatcher()
+	defer pidFiles.close()
+	pidFiles.sync(e.programs())
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			e.discover(processFinder)
+			// The config may have been reloaded with different pid files
+			pidFiles.sync(e.programs())
+		case event := <-pidFiles.events():
+			e.pidFileChanged(processFinder, event.Name)
+		case <-retryTicker.C:
+			e.retryDue(processFinder)
+		case event, ok := <-events:
+			if !ok {
+				zap.S().Warnf("Process events are no longer available, falling back to rescanning processes every %s", interval)
+				events = nil
+				continue
+			}
+			e.handleEvent(processFinder, event)
+		}
+	}
+}
+
+// handleEvent attaches or detaches programs as required by a process event
+func (e *Exporter) handleEvent(processFinder process.Finder, event process.Event) {
+	e.attachMu.Lock()
+	defer e.attachMu.Unlock()
+	zap.S().Debugf("Handling %s event for pid %d", event.Type, event.PID)
+	switch event.Type {
+	case process.Fork:
+		e.attachToPid(processFinder, event.PID)
+	case process.Exec:
+		// The process image was replaced, so whatever was attached to the old one is gone
+		e.detachPid(event.PID)
+		e.attachToPid(processFinder, event.PID)
+	case process.Exit:
+		e.detachPid(event.PID)
+	}
+}
+
+// attachToPid attaches every program whose attachment matches the pid
+func (e *Exporter) attachToPid(processFinder process.Finder, pid int) {
+	proc, err := processFinder.Proc(pid)
 	if err != nil {
-		return fmt.Errorf("Unable to get executable path for pid %d: %w", proc.PID, err)
+		// Short-lived processes are often gone by the time we get to them
+		zap.S().Debugf("Skipping pid %d: %s", pid, err)
+		return
+	}
+	for _, program := range e.config.Programs {
+		// Telling whether the process is a root or a leaf takes a scan of every process,
+		// which is too much for every fork and exec, so those are left to the rescans
+		if program.Attachment.Path != "" || program.Attachment.FiltersTree() {
+			continue
+		}
+		matches, err := processFinder.Matches(proc, program.Attachment)
+		if err != nil {
+			zap.S().Debugf("Skipping pid %d for ebpf program %s: %s", pid, program.Name, err)
+			continue
+		}
+		if !matches {
+			continue
+		}
+		e.attachProgramToProcs(program, procfs.Procs{proc})
 	}
-	for symbol, probe := range probes {
+}
+
+// discover detaches programs from processes that have exited, then attaches every
+// program to the matching processes it isn't yet attached to
+func (e *Exporter) discover(processFinder process.Finder) {
+	e.attachMu.Lock()
+	defer e.attachMu.Unlock()
+	e.reap(processFinder)
+	e.reapRetries(processFinder)
+	e.rescanMissingProbes(processFinder)
+	for _, program := range e.config.Programs {
+		if program.Attachment.Path != "" {
+			e.attachToPath(program)
+			continue
+		}
+		if program.Attachment.PidFile != "" {
+			e.followPidFile(processFinder, program)
+			continue
+		}
+		procs, err := e.findProcs(processFinder, program)
+		if err != nil {
+			zap.S().Errorf("Error searching for process with %s for ebpf program %s: %s", program.Attachment, program.Name, err)
+			continue
+		}
+		e.attachProgramToProcs(program, procs)
+	}
+}
+
+// findProcs finds the processes matching the program's attachment, keeping track of
+// whether its pid file, if any, is stale. A pid file that can't be read doesn't lead to a
+// running process either, so it's stale too.
+func (e *Exporter) findProcs(processFinder process.Finder, program config.Program) (procfs.Procs, error) {
+	procs, err := processFinder.Find(program.Attachment)
+	if program.Attachment.PidFile != "" {
+		e.mu.Lock()
+		e.stalePidFiles[program.Name] = err != nil
+		e.mu.Unlock()
+	}
+	return procs, err
+}
+
+// attachProgramToProcs attaches the program to every given process it isn't already attached to.
+// Failing to attach to one process doesn't stop it from attaching to the rest; failures are
+// logged and counted, and the number of processes the program is attached to is returned.
+// Processes that failed before are only attempted again once their backoff expires.
+func (e *Exporter) attachProgramToProcs(program config.Program, procs procfs.Procs) int {
+	attached := 0
+	now := time.Now()
+	for _, proc := range procs {
+		if e.isAttached(program.Name, proc.PID) {
+			attached++
+			continue
+		}
+		stat, err := proc.Stat()
+		if err != nil {
+			zap.S().Debugf("Skipping pid %d for ebpf program %s: %s", proc.PID, program.Name, err)
+			continue
+		}
+		if !e.shouldAttempt(program.Name, proc.PID, stat.Starttime, now) {
+			continue
+		}
+		err = e.attachProc(program, proc)
+		if err == nil {
+			e.forgetRetries(program.Name, proc.PID)
+			attached++
+			continue
+		}
+		stage := e.countAttachError(program.Name, proc.PID, err)
+		zap.S().Errorf("Error attaching ebpf program %s to pid %d at stage %s: %s", program.Name, proc.PID, stage, err)
+		e.recordFailure(program, proc.PID, stat.Starttime, now)
+	}
+	return attached
+}
+
+// countAttachError counts a failure to attach the program to the pid in the attach errors
+// metric, returning the stage it failed at
+func (e *Exporter) countAttachError(programName string, pid int, err error) string {
+	stage := stageProcess
+	var attachErr *attachError
+	if errors.As(err, &attachErr) {
+		stage = attachErr.stage
+	}
+	e.attachErrors.WithLabelValues(programName, strconv.Itoa(pid), stage).Inc()
+	return stage
+}
+
+// reap detaches every program from the attached processes that are no longer running
+func (e *Exporter) reap(processFinder process.Finder) {
+	e.mu.RLock()
+	dead := []int{}
+	for pid, startTime := range e.startTimes {
+		if !processFinder.IsRunning(pid, startTime) {
+			dead = append(dead, pid)
+		}
+	}
+	e.mu.RUnlock()
+	for _, pid := range dead {
+		e.detachPid(pid)
+	}
+}
+
+// detachPid closes the modules and usdt contexts held for the pid, and stops reporting metrics for it
+func (e *Exporter) detachPid(pid int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for programName, byPid := range e.modules {
+		if _, ok := byPid[pid]; ok {
+			e.detachProc(programName, pid)
+			zap.S().Infof("Program %s detached from pid %d", programName, pid)
+		}
+	}
+	for _, byPid := range e.retries {
+		delete(byPid, pid)
+	}
+	delete(e.startTimes, pid)
+	// Collect can't be using the symbolizer, or create it again, while mu is held
+	e.closeSymbolizer(pid)
+}
+
+// detachLocked detaches the named program from the pid, closing its module and usdt context,
+// or only its uprobes if the module is shared. The caller must hold mu.
+func (e *Exporter) detachLocked(programName string, pid int) {
+	if context, ok := e.usdtContexts[programName][pid]; ok {
+		context.Close()
+		delete(e.usdtContexts[programName], pid)
+		zap.S().Debugf("Closed usdt context of program %s for pid %d", programName, pid)
+	}
+	if module, ok := e.sharedModules[programName]; ok {
+		for _, probe := range e.sharedProbes[programName][pid] {
+			probe.Close()
+		}
+		delete(e.sharedProbes[programName], pid)
+		if pid != systemWidePid {
+			e.dropPidKeysLocked(programName, pid, module)
+		}
+	} else if module, ok := e.modules[programName][pid]; ok {
+		module.Close()
+	}
+	delete(e.missingProbes[programName], pid)
+	delete(e.modules[programName], pid)
+}
+
+// isAttached returns whether the named program is attached to the pid
+func (e *Exporter) isAttached(programName string, pid int) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	_, ok := e.modules[programName][pid]
+	return ok
+}
+
+// attachProbesToProc attaches each probe to its location for the pid, or for every process if
+// the pid is -1. Locations are in the executable unless they're given as lib:location, where
+// lib is either a path or the short name of a library the process has loaded. Patterns are
+// attached to every symbol they match, up to maxSymbols. Locations that aren't the start of
+// a symbol are translated to virtual addresses and attached with addressAttacher, or
+// rejected if there's none.
+func (e *Exporter) attachProbesToProc(probes map[string]string, maxSymbols int, executablePath string, pid int, loader func(string) (int, error), attacher func(string, string, int, int) error, addressAttacher func(string, uint64, int, int) error) error {
+	for key, probe := range probes {
 		fd, err := loader(probe)
 		if err != nil {
 			return fmt.Errorf("Unable to load uprobe %s: %w", probe, err)
 		}
-		parts := strings.Split(symbol, ":")
-		if len(parts) == 1 {
-			err = attacher(executablePath, symbol, fd, proc.PID)
+		binary, location, err := probeLocation(key, executablePath, pid)
+		if err != nil {
+			return fmt.Errorf("Unable to attach uprobe %s: %w", probe, err)
+		}
+		if location.IsSymbol() {
+			err = attacher(binary, location.Symbol, fd, pid)
+		} else if location.Kind == uprobe.PatternLocation {
+			err = attachByPattern(binary, location, maxSymbols, fd, pid, attacher)
+		} else if addressAttacher == nil {
+			err = fmt.Errorf("%s is not the start of a symbol, which is the only place this probe can be attached to", location)
 		} else {
-			err = attacher(parts[0], parts[1], fd, proc.PID)
+			err = attachByAddress(binary, location, fd, pid, addressAttacher)
 		}
 		if err != nil {
 			return fmt.Errorf("Unable to attach uprobe %s: %w", probe, err)
@@ -98,114 +575,383 @@ func (e *Exporter) attachProbesToProc(probes map[string]string, proc procfs.Proc
 	return nil
 }
 
-func (e *Exporter) attachProgramToProc(program config.Program, proc procfs.Proc) error {
+// attachGoUretprobes attaches each probe to every return instruction of its Go function in the
+// executable, for the pid or for every process if it's -1, to emulate a uretprobe
+func (e *Exporter) attachGoUretprobes(probes map[string]string, executablePath string, pid int, loader func(string) (int, error), addressAttacher func(string, uint64, int, int) error) error {
+	if len(probes) == 0 {
+		return nil
+	}
+	path, err := hostPath(executablePath, pid)
+	if err != nil {
+		return err
+	}
+	for function, probe := range probes {
+		fd, err := loader(probe)
+		if err != nil {
+			return fmt.Errorf("Unable to load uprobe %s: %w", probe, err)
+		}
+		addresses, err := uprobe.GoReturnAddresses(path, function)
+		if err != nil {
+			return fmt.Errorf("Unable to attach uprobe %s: %w", probe, err)
+		}
+		zap.S().Debugf("Attaching %s to %d return instructions of %s", probe, len(addresses), function)
+		for _, address := range addresses {
+			if err := addressAttacher(executablePath, address, fd, pid); err != nil {
+				return fmt.Errorf("Unable to attach uprobe %s: %w", probe, err)
+			}
+		}
+	}
+	return nil
+}
+
+// argumentStubs returns the code defining the usdt arguments of every function whose probes
+// are all unavailable, so that it still compiles. The arguments of a function with an enabled
+// probe are defined by the usdt context, so it gets no stubs.
+func argumentStubs(unavailable, enabled map[string]bool) string {
+	fnNames := []string{}
+	for fnName := range unavailable {
+		if !enabled[fnName] {
+			fnNames = append(fnNames, fnName)
+		}
+	}
+	sort.Strings(fnNames)
+	stubs := ""
+	for _, fnName := range fnNames {
+		stubs += usdt.ArgumentStubs(fnName)
+	}
+	return stubs
+}
+
+// probeLocation splits the key of a probe into the binary it's in and its location in it
+func probeLocation(key, executablePath string, pid int) (string, uprobe.Location, error) {
+	binary := executablePath
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) == 2 {
+		binary = parts[0]
+		if pid != systemWidePid && !strings.Contains(binary, "/") {
+			// Left to bcc, the name would be looked up in our own mount namespace
+			var err error
+			binary, err = process.ResolveLibrary(pid, binary)
+			if err != nil {
+				return "", uprobe.Location{}, err
+			}
+		}
+	}
+	location, err := uprobe.ParseLocation(parts[len(parts)-1])
+	return binary, location, err
+}
+
+// attachByAddress translates the location in the binary to a virtual address, and attaches the probe there
+func attachByAddress(binary string, location uprobe.Location, fd, pid int, addressAttacher func(string, uint64, int, int) error) error {
+	path, err := hostPath(binary, pid)
+	if err != nil {
+		return err
+	}
+	address, err := location.Address(path)
+	if err != nil {
+		return err
+	}
+	zap.S().Debugf("Resolved %s in %s to address 0x%x", location, binary, address)
+	return addressAttacher(binary, address, fd, pid)
+}
+
+// attachByPattern attaches the probe to every symbol in the binary that matches the location's pattern
+func attachByPattern(binary string, location uprobe.Location, maxSymbols, fd, pid int, attacher func(string, string, int, int) error) error {
+	path, err := hostPath(binary, pid)
+	if err != nil {
+		return err
+	}
+	symbols, err := location.MatchingSymbols(path)
+	if err != nil {
+		return err
+	}
+	if len(symbols) == 0 {
+		return fmt.Errorf("No symbols in %s match %s", binary, location)
+	}
+	if len(symbols) > maxSymbols {
+		return fmt.Errorf("%d symbols in %s match %s, more than the %d allowed by max_probe_symbols", len(symbols), binary, location, maxSymbols)
+	}
+	zap.S().Debugf("Attaching to %d symbols in %s matching %s", len(symbols), binary, location)
+	for _, symbol := range symbols {
+		if err := attacher(binary, symbol, fd, pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostPath returns a path to the binary that can be opened from our mount namespace,
+// given the path the process sees it at
+func hostPath(binary string, pid int) (string, error) {
+	if !filepath.IsAbs(binary) {
+		return "", fmt.Errorf("%s must be given as a path to attach to anything but a single symbol", binary)
+	}
+	root := process.RootPath(pid)
+	if pid == systemWidePid || strings.HasPrefix(binary, root+"/") {
+		return binary, nil
+	}
+	resolved, err := process.ResolveInRoot(pid, binary)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// Stages at which attaching a program to a process may fail, reported in the attach errors metric
+const (
+	stageProcess         = "process"
+	stageUSDTContext     = "usdt_context"
+	stageUSDTEnable      = "usdt_enable"
+	stageUSDTArguments   = "usdt_arguments"
+	stageCompile         = "compile"
+	stageUSDTAttach      = "usdt_attach"
+	stageUprobeAttach    = "uprobe_attach"
+	stageUretprobeAttach = "uretprobe_attach"
+	stageGoUretprobe     = "go_uretprobe_attach"
+)
+
+// attachError is an error attaching a program to a process, along with the stage it failed at
+type attachError struct {
+	stage string
+	err   error
+}
+
+func (e *attachError) Error() string {
+	return e.err.Error()
+}
+
+func (e *attachError) Unwrap() error {
+	return e.err
+}
+
+// attachProgramToProc attaches the program to the process. If any stage fails, everything
+// done up to that point is undone, so the process is left as if it had never been attached to.
+func (e *Exporter) attachProgramToProc(program config.Program, proc procfs.Proc) (err error) {
+	if program.UsesSharedModule() {
+		return e.attachSharedProgramToProc(program, proc)
+	}
 	pid := proc.PID
+	stat, err := proc.Stat()
+	if err != nil {
+		return &attachError{stageProcess, fmt.Errorf("Unable to get start time for pid %d: %w", pid, err)}
+	}
+	executablePath, err := process.ExecutablePath(proc)
+	if err != nil {
+		return &attachError{stageProcess, err}
+	}
 	code := program.Code
 	var usdtContext *usdt.Context
+	var module *bcc.Module
+	defer func() {
+		if err == nil {
+			return
+		}
+		if module != nil {
+			module.Close()
+		}
+		if usdtContext != nil {
+			usdtContext.Close()
+		}
+	}()
+	if err = checkUSDTMetricArguments(program, mappedPaths(pid)); err != nil {
+		return err
+	}
+	// Probes that aren't available yet may be in a library the process hasn't loaded yet
+	var unavailable []string
 	if len(program.USDT) > 0 {
-		var err error
 		usdtContext, err = usdt.NewContext(pid)
 		if err != nil {
-			return fmt.Errorf("Can't initialize usdt context for %s: %w", program.Name, err)
+			return &attachError{stageUSDTContext, fmt.Errorf("Can't initialize usdt context for %s: %w", program.Name, err)}
 		}
+		var enableErrs []error
+		enabled := map[string]bool{}
+		stubbed := map[string]bool{}
 		for probe, fnName := range program.USDT {
 			zap.S().Debugf("Enabling %s for %s...", fnName, probe)
-			err := usdtContext.EnableProbe(probe, fnName)
-			if err != nil {
-				return err
+			if enableErr := usdtContext.EnableProbe(probe, fnName); enableErr != nil {
+				unavailable = append(unavailable, probe)
+				enableErrs = append(enableErrs, enableErr)
+				stubbed[fnName] = true
+				continue
 			}
+			enabled[fnName] = true
 			zap.S().Debugf("Function %s enabled for probe %s", fnName, probe)
 		}
+		if len(unavailable) == len(program.USDT) {
+			return &attachError{stageUSDTEnable, enableErrs[0]}
+		}
+		code = argumentStubs(stubbed, enabled) + code
+		// Every unavailable probe is counted, so that a misspelled one doesn't go unnoticed just
+		// because the others were enabled
+		for _, enableErr := range enableErrs {
+			e.countAttachError(program.Name, pid, &attachError{stageUSDTEnable, enableErr})
+		}
 		code, err = usdtContext.AddUSDTArguments(code)
 		if err != nil {
-			return fmt.Errorf("Unable to add usdt arguments for program %s: %w", program.Name, err)
+			return &attachError{stageUSDTArguments, fmt.Errorf("Unable to add usdt arguments for program %s: %w", program.Name, err)}
 		}
 	}
-	module := bcc.NewModule(code, program.Cflags)
+	module, err = e.compile(program, code)
+	if err != nil {
+		return err
+	}
 	if usdtContext != nil {
-		err := usdtContext.AttachUprobes(module)
+		err = usdtContext.AttachUprobes(module)
 		if err != nil {
-			return fmt.Errorf("Unable to attach USDT uprobes for program %s: %w", program.Name, err)
+			return &attachError{stageUSDTAttach, fmt.Errorf("Unable to attach USDT uprobes for program %s: %w", program.Name, err)}
 		}
 	}
-	if err := e.attachProbesToProc(program.Uprobes, proc, module.LoadUprobe, module.AttachUprobe); err != nil {
-		return fmt.Errorf("Unable to attach uprobes for program %s: %w", program.Name, err)
+	if err = e.attachProbesToProc(program.Uprobes, program.ProbeSymbolLimit(), executablePath, pid, module.LoadUprobe, module.AttachUprobe, module.AttachUprobeByAddr); err != nil {
+		return &attachError{stageUprobeAttach, fmt.Errorf("Unable to attach uprobes for program %s: %w", program.Name, err)}
 	}
-	if err := e.attachProbesToProc(program.Uretprobes, proc, module.LoadUprobe, module.AttachUretprobe); err != nil {
-		return fmt.Errorf("Unable to attach uprobes for program %s: %w", program.Name, err)
+	if err = e.attachProbesToProc(program.Uretprobes, program.ProbeSymbolLimit(), executablePath, pid, module.LoadUprobe, module.AttachUretprobe, nil); err != nil {
+		return &attachError{stageUretprobeAttach, fmt.Errorf("Unable to attach uretprobes for program %s: %w", program.Name, err)}
+	}
+	if err = e.attachGoUretprobes(program.GoUretprobes, executablePath, pid, module.LoadUprobe, module.AttachUprobeByAddr); err != nil {
+		return &attachError{stageGoUretprobe, fmt.Errorf("Unable to attach go uretprobes for program %s: %w", program.Name, err)}
 	}
 
 	zap.S().Infof("Program %s attached to pid %d", program.Name, pid)
+	var missing *missingProbes
+	if len(unavailable) > 0 {
+		missing = newMissingProbes(program.Name, pid, unavailable)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if missing != nil {
+		if _, ok := e.missingProbes[program.Name]; !ok {
+			e.missingProbes[program.Name] = map[int]*missingProbes{}
+		}
+		e.missingProbes[program.Name][pid] = missing
+	} else {
+		delete(e.missingProbes[program.Name], pid)
+	}
 	if _, ok := e.modules[program.Name]; !ok {
 		e.modules[program.Name] = make(map[int]*bcc.Module)
-		if usdtContext != nil {
-			e.usdtContexts[program.Name] = make(map[int]*usdt.Context)
-		}
+	}
+	if _, ok := e.usdtContexts[program.Name]; !ok && usdtContext != nil {
+		e.usdtContexts[program.Name] = make(map[int]*usdt.Context)
 	}
 	e.modules[program.Name][pid] = module
+	e.startTimes[pid] = stat.Starttime
 	if usdtContext != nil {
 		e.usdtContexts[program.Name][pid] = usdtContext
 	}
 	return nil
 }
 
+// compile compiles the code of the program into a new module, keeping track of how long it took
+func (e *Exporter) compile(program config.Program, code string) (*bcc.Module, error) {
+	start := time.Now()
+	module := bcc.NewModule(code, program.Cflags)
+	e.compileDuration.WithLabelValues(program.Name).Observe(time.Since(start).Seconds())
+	if module == nil {
+		return nil, &attachError{stageCompile, fmt.Errorf("Unable to compile program %s", program.Name)}
+	}
+	return module, nil
+}
+
 // Close releases any resources that the exporter is holding on to.
 func (e *Exporter) Close() {
-	for _, byPid := range e.usdtContexts {
-		for _, context := range byPid {
-			context.Close()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for programName, byPid := range e.modules {
+		for pid := range byPid {
+			e.detachLocked(programName, pid)
 		}
 	}
-	for _, byPid := range e.modules {
-		for _, module := range byPid {
-			module.Close()
-		}
+	for _, module := range e.sharedModules {
+		module.Close()
+	}
+	e.symbolizersMu.Lock()
+	defer e.symbolizersMu.Unlock()
+	for _, symbolizer := range e.symbolizers {
+		symbolizer.Close()
 	}
 }
 
 // Describe satisfies prometheus.Collector interface by sending descriptions
 // for all metrics the exporter can possibly report
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	addDescs := func(programName string, name string, help string, labels []ebpf_config.Label) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.buildDescsLocked()
+
+	ch <- e.enabledProgramsDesc
+	ch <- e.pendingProgramsDesc
+	ch <- e.stalePidFileDesc
+	e.attachErrors.Describe(ch)
+	e.compileDuration.Describe(ch)
+	ch <- e.attachFailedAttemptsDesc
+	ch <- e.attachRetriesExhaustedDesc
+
+	for _, program := range e.config.Programs {
+		for _, desc := range e.descs[program.Name] {
+			ch <- desc
+		}
+	}
+}
+
+// buildDescsLocked builds the descs of every metric of the config's programs that doesn't have
+// one yet, so that they're ready before Collect sees the programs. The caller must hold mu.
+func (e *Exporter) buildDescsLocked() {
+	addDescs := func(program config.Program, name string, help string, labels []ebpf_config.Label) {
+		programName := program.Name
 		if _, ok := e.descs[programName][name]; !ok {
 			labelNames := []string{}
 
 			for _, label := range labels {
 				labelNames = append(labelNames, label.Name)
 			}
-			labelNames = append(labelNames, "pid")
+			// A shared module's maps hold every process, so the pid can only come from their keys
+			if !program.UsesSharedModule() {
+				labelNames = append(labelNames, "pid")
+			}
 
 			e.descs[programName][name] = prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", name), help, labelNames, nil)
 		}
-
-		ch <- e.descs[programName][name]
 	}
 
-	ch <- e.enabledProgramsDesc
-
 	for _, program := range e.config.Programs {
 		if _, ok := e.descs[program.Name]; !ok {
 			e.descs[program.Name] = map[string]*prometheus.Desc{}
 		}
 
 		for _, counter := range program.Metrics.Counters {
-			addDescs(program.Name, counter.Name, counter.Help, counter.Labels)
+			addDescs(program, counter.Name, counter.Help, counter.Labels)
 		}
 
 		for _, histogram := range program.Metrics.Histograms {
-			addDescs(program.Name, histogram.Name, histogram.Help, histogram.Labels[0:len(histogram.Labels)-1])
+			addDescs(program, histogram.Name, histogram.Help, histogram.Labels[0:len(histogram.Labels)-1])
 		}
 	}
 }
 
 // Collect satisfies prometheus.Collector interface and sends all metrics
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	for _, program := range e.config.Programs {
 		for pid := range e.modules[program.Name] {
 			ch <- prometheus.MustNewConstMetric(e.enabledProgramsDesc, prometheus.GaugeValue, 1, program.Name, strconv.Itoa(pid))
 		}
+		if len(e.modules[program.Name]) == 0 {
+			ch <- prometheus.MustNewConstMetric(e.pendingProgramsDesc, prometheus.GaugeValue, 1, program.Name)
+		}
+		if stale, ok := e.stalePidFiles[program.Name]; ok {
+			value := 0.0
+			if stale {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(e.stalePidFileDesc, prometheus.GaugeValue, value, program.Name, program.Attachment.PidFile)
+		}
 	}
 
+	e.attachErrors.Collect(ch)
+	e.compileDuration.Collect(ch)
+	e.collectRetries(ch)
 	e.collectCounters(ch)
 	e.collectHistograms(ch)
 }
@@ -214,8 +960,8 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 func (e *Exporter) collectCounters(ch chan<- prometheus.Metric) {
 	for _, program := range e.config.Programs {
 		for _, counter := range program.Metrics.Counters {
-			for pid, module := range e.modules[program.Name] {
-				tableValues, err := e.tableValues(module, counter.Table, counter.Labels)
+			for _, source := range e.metricSources(program) {
+				tableValues, err := e.tableValues(source, counter.Table, counter.Labels)
 				if err != nil {
 					zap.S().Errorf("Error getting table %q values for metric %q of program %q: %w", counter.Table, counter.Name, program.Name, err)
 					continue
@@ -225,7 +971,7 @@ func (e *Exporter) collectCounters(ch chan<- prometheus.Metric) {
 
 				for _, metricValue := range tableValues {
 					labels := metricValue.labels
-					labels = append(labels, strconv.Itoa(pid))
+					labels = append(labels, source.labels...)
 					ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, metricValue.value, labels...)
 				}
 			}
@@ -237,12 +983,12 @@ func (e *Exporter) collectCounters(ch chan<- prometheus.Metric) {
 func (e *Exporter) collectHistograms(ch chan<- prometheus.Metric) {
 	for _, program := range e.config.Programs {
 		for _, histogram := range program.Metrics.Histograms {
-			for pid, module := range e.modules[program.Name] {
+			for _, source := range e.metricSources(program) {
 				skip := false
 
 				histograms := map[string]histogramWithLabels{}
 
-				tableValues, err := e.tableValues(module, histogram.Table, histogram.Labels)
+				tableValues, err := e.tableValues(source, histogram.Table, histogram.Labels)
 				if err != nil {
 					zap.S().Errorf("Error getting table %q values for metric %q of program %q: %w", histogram.Table, histogram.Name, program.Name, err)
 					continue
@@ -259,7 +1005,7 @@ func (e *Exporter) collectHistograms(ch chan<- prometheus.Metric) {
 				// * [sda, read] -> {1ms -> 10, 2ms -> 2, 4ms -> 5}
 				for _, metricValue := range tableValues {
 					labels := metricValue.labels[0 : len(metricValue.labels)-1]
-					labels = append(labels, strconv.Itoa(pid))
+					labels = append(labels, source.labels...)
 
 					key := fmt.Sprintf("%#v", labels)
 
@@ -305,10 +1051,33 @@ func (e *Exporter) collectHistograms(ch chan<- prometheus.Metric) {
 	}
 }
 
+// metricSource is a module whose maps metrics are read from, along with the labels
+// that tell it apart from the program's other modules
+type metricSource struct {
+	module *bcc.Module
+	labels []string
+	// pid is the process the module is attached to, or -1 for a shared module
+	pid int
+}
+
+// metricSources returns the modules the program's metrics are read from: a module for each
+// pid, labelled with it, or the shared module by itself
+func (e *Exporter) metricSources(program config.Program) []metricSource {
+	if module, ok := e.sharedModules[program.Name]; ok {
+		return []metricSource{{module: module, pid: systemWidePid}}
+	}
+	sources := []metricSource{}
+	for pid, module := range e.modules[program.Name] {
+		sources = append(sources, metricSource{module: module, labels: []string{strconv.Itoa(pid)}, pid: pid})
+	}
+	return sources
+}
+
 // tableValues returns values in the requested table to be used in metircs
-func (e *Exporter) tableValues(module *bcc.Module, tableName string, labels []ebpf_config.Label) ([]metricValue, error) {
+func (e *Exporter) tableValues(source metricSource, tableName string, labels []ebpf_config.Label) ([]metricValue, error) {
 	values := []metricValue{}
 
+	module := source.module
 	table := bcc.NewTable(module.TableId(tableName), module)
 	iter := table.Iter()
 
@@ -324,7 +1093,7 @@ func (e *Exporter) tableValues(module *bcc.Module, tableName string, labels []eb
 			labels: make([]string, len(labels)),
 		}
 
-		mv.labels, err = e.decoders.DecodeLabels(key, labels)
+		mv.labels, err = e.decodeLabels(key, labels, source.pid)
 		if err != nil {
 			if err == decoder.ErrSkipLabelSet {
 				continue
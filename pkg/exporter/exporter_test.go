@@ -0,0 +1,129 @@
+package exporter
+
+import (
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/uprobe"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/usdt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReloadBuildsDescs(t *testing.T) {
+	e, _ := newTestExporter()
+	program := newTestProgram("no-such-binary")
+	program.Metrics.Counters = []ebpf_config.Counter{{Name: "calls_total", Table: "calls"}}
+	if err := e.Reload(config.Config{Programs: []config.Program{program}}); err != nil {
+		t.Fatal(err)
+	}
+	// Collect may run before the exporter is described again
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.descs[program.Name]["calls_total"] == nil {
+		t.Errorf("Expected Reload to build the desc of the new counter")
+	}
+}
+
+func TestArgumentStubs(t *testing.T) {
+	tests := []struct {
+		name        string
+		unavailable map[string]bool
+		enabled     map[string]bool
+		expected    string
+	}{
+		{
+			name:        "every probe unavailable",
+			unavailable: map[string]bool{"trace_stop": true, "trace_start": true},
+			expected:    usdt.ArgumentStubs("trace_start") + usdt.ArgumentStubs("trace_stop"),
+		},
+		{
+			name:        "function shared by an enabled probe",
+			unavailable: map[string]bool{"trace_call": true, "trace_stop": true},
+			enabled:     map[string]bool{"trace_call": true},
+			expected:    usdt.ArgumentStubs("trace_stop"),
+		},
+		{
+			name:     "every probe enabled",
+			enabled:  map[string]bool{"trace_call": true},
+			expected: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if stubs := argumentStubs(test.unavailable, test.enabled); stubs != test.expected {
+				t.Errorf("Expected stubs:\n%s\ngot:\n%s", test.expected, stubs)
+			}
+		})
+	}
+}
+
+// buildGoFixture builds the Go program the uprobe package tests with, skipping the test if
+// there's no Go toolchain. Test binaries themselves are stripped of their symbols.
+func buildGoFixture(t *testing.T) string {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No go toolchain to build the fixture with")
+	}
+	dir, err := ioutil.TempDir("", "gofunc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	binary := filepath.Join(dir, "gofunc")
+	cmd := exec.Command(goTool, "build", "-o", binary, ".")
+	cmd.Dir = filepath.Join("..", "uprobe", "testdata", "gofunc")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GOFLAGS=")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Unable to build fixture: %s\n%s", err, output)
+	}
+	return binary
+}
+
+func TestAttachByPattern(t *testing.T) {
+	binary := buildGoFixture(t)
+	tests := []struct {
+		pattern    string
+		maxSymbols int
+		expected   []string
+		err        string
+	}{
+		{pattern: "main.[cs]*", maxSymbols: 2, expected: []string{"main.classify", "main.shift"}},
+		{pattern: "main.[cs]*", maxSymbols: 1, err: "2 symbols in"},
+		{pattern: "runtime.*", maxSymbols: 10, err: "more than the 10 allowed by max_probe_symbols"},
+		{pattern: "no_such_function_*", maxSymbols: 10, err: "No symbols in"},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			location, err := uprobe.ParseLocation(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attached := []string{}
+			attacher := func(name, symbol string, fd, pid int) error {
+				attached = append(attached, symbol)
+				return nil
+			}
+			err = attachByPattern(binary, location, test.maxSymbols, 3, systemWidePid, attacher)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected an error containing %q, got %v", test.err, err)
+				}
+				if len(attached) != 0 {
+					t.Errorf("Expected nothing to be attached, got %v", attached)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(attached, test.expected) {
+				t.Errorf("Expected %v to be attached, got %v", test.expected, attached)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package exporter
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/prometheus/procfs"
+	"go.uber.org/zap"
+	"path/filepath"
+)
+
+// pidFileWatcher watches the directories of the programs' pid files, so that a pid file
+// is followed as soon as it changes rather than on the next rescan
+type pidFileWatcher struct {
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+}
+
+// newPidFileWatcher returns a watcher for pid files, or nil if they can't be watched, in
+// which case they are only followed on rescans
+func newPidFileWatcher() *pidFileWatcher {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		zap.S().Warnf("Unable to watch pid files, they will only be read on every rescan: %s", err)
+		return nil
+	}
+	return &pidFileWatcher{watcher: watcher, dirs: map[string]bool{}}
+}
+
+// events returns the channel changes to the watched directories are delivered on
+func (w *pidFileWatcher) events() <-chan fsnotify.Event {
+	if w == nil {
+		return nil
+	}
+	return w.watcher.Events
+}
+
+// close stops watching every directory
+func (w *pidFileWatcher) close() {
+	if w != nil {
+		w.watcher.Close()
+	}
+}
+
+// sync watches the directories of the pid files of the programs, and stops watching the
+// directories no program needs anymore. Directories are watched rather than the files
+// themselves, since pid files are usually replaced rather than written to.
+func (w *pidFileWatcher) sync(programs []config.Program) {
+	if w == nil {
+		return
+	}
+	dirs := map[string]bool{}
+	for _, program := range programs {
+		if program.Attachment.PidFile != "" {
+			dirs[filepath.Dir(filepath.Clean(program.Attachment.PidFile))] = true
+		}
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			w.watcher.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			zap.S().Debugf("Unable to watch %s for pid file changes: %s", dir, err)
+			continue
+		}
+		w.dirs[dir] = true
+	}
+}
+
+// pidFileChanged follows every pid file at the path of the changed file
+func (e *Exporter) pidFileChanged(processFinder process.Finder, path string) {
+	e.attachMu.Lock()
+	defer e.attachMu.Unlock()
+	for _, program := range e.config.Programs {
+		if program.Attachment.PidFile != "" && filepath.Clean(program.Attachment.PidFile) == filepath.Clean(path) {
+			zap.S().Debugf("Pid file %s of program %s changed", path, program.Name)
+			e.followPidFile(processFinder, program)
+		}
+	}
+}
+
+// followPidFile attaches the program to the process its pid file names, and detaches it
+// from any process the file named before. The caller must hold attachMu.
+func (e *Exporter) followPidFile(processFinder process.Finder, program config.Program) {
+	procs, err := e.findProcs(processFinder, program)
+	var staleErr *process.StalePidFileError
+	if err != nil && !errors.As(err, &staleErr) {
+		// The file may be halfway through being rewritten, so keep what's attached until it can be read
+		zap.S().Errorf("Error searching for process with %s for ebpf program %s: %s", program.Attachment, program.Name, err)
+		return
+	}
+	e.detachUnnamed(program.Name, procs)
+	if err != nil {
+		zap.S().Errorf("Error searching for process with %s for ebpf program %s: %s", program.Attachment, program.Name, err)
+		return
+	}
+	e.attachProgramToProcs(program, procs)
+}
+
+// detachUnnamed detaches the program from every process it's attached to but the given ones,
+// even if they're still running
+func (e *Exporter) detachUnnamed(programName string, procs procfs.Procs) {
+	named := map[int]bool{}
+	for _, proc := range procs {
+		named[proc.PID] = true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for pid := range e.modules[programName] {
+		if named[pid] {
+			continue
+		}
+		e.detachProc(programName, pid)
+		delete(e.retries[programName], pid)
+		zap.S().Infof("Program %s detached from pid %d, which its pid file no longer names", programName, pid)
+		if !e.isAttachedToAnyLocked(pid) {
+			delete(e.startTimes, pid)
+			e.closeSymbolizer(pid)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package exporter
+
+import (
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/usdt"
+	"go.uber.org/zap"
+	"path/filepath"
+	"strings"
+)
+
+// missingProbes tracks the usdt probes of a program that weren't available in a process
+// when the program was attached to it
+type missingProbes struct {
+	probes []string
+	// files are the files the process had mapped, so that only new ones trigger a rescan
+	files map[string]bool
+}
+
+// newMissingProbes starts tracking the probes of the program that weren't available in the
+// process, along with the files it has mapped so far, so that the probes can be enabled once
+// a library that provides them is loaded
+func newMissingProbes(programName string, pid int, probes []string) *missingProbes {
+	files, err := process.MappedFiles(pid)
+	if err != nil {
+		zap.S().Debugf("%s", err)
+		files = map[string]bool{}
+	}
+	zap.S().Warnf("Program %s attached to pid %d without usdt probes %s, which will be enabled once the process loads them",
+		programName, pid, strings.Join(probes, ", "))
+	return &missingProbes{probes: probes, files: files}
+}
+
+// missingProbesScan is what a rescan needs to know about a process with missing probes
+type missingProbesScan struct {
+	programName string
+	pid         int
+	missing     *missingProbes
+	files       map[string]bool
+	available   bool
+}
+
+// rescanMissingProbes checks every process that a program is attached to without some of its
+// usdt probes for newly mapped files, such as dlopen'd libraries. If any of the missing probes
+// are now available, they're enabled. The caller must hold attachMu.
+func (e *Exporter) rescanMissingProbes(processFinder process.Finder) {
+	scans := []*missingProbesScan{}
+	e.mu.RLock()
+	for programName, byPid := range e.missingProbes {
+		for pid, missing := range byPid {
+			scans = append(scans, &missingProbesScan{programName: programName, pid: pid, missing: missing})
+		}
+	}
+	e.mu.RUnlock()
+	// Reading the process's maps and the notes of its files is left out of the lock, so that
+	// Collect isn't held up by it. The probes' files and names only change when attaching,
+	// which attachMu keeps from happening meanwhile.
+	for _, scan := range scans {
+		files, err := processFinder.MappedFiles(scan.pid)
+		if err != nil {
+			continue
+		}
+		scan.files = files
+		scan.available = declaresAnyProbe(processFinder, scan.pid, newFiles(scan.missing.files, files), scan.missing.probes)
+	}
+	e.mu.Lock()
+	for _, scan := range scans {
+		if scan.files != nil {
+			scan.missing.files = scan.files
+		}
+	}
+	e.mu.Unlock()
+	for _, program := range e.config.Programs {
+		for _, scan := range scans {
+			if scan.available && scan.programName == program.Name {
+				e.enableMissingProbes(processFinder, program, scan.pid)
+			}
+		}
+	}
+}
+
+// enableMissingProbes attaches the program to the process again, with the missing usdt probes
+// that have become available. The usdt arguments are compiled into the module, so it has to be
+// compiled again, but the new module is attached alongside the current one, and only replaces
+// it once it has been attached successfully, adding its tables' counts to its own so that none are lost.
+// If anything fails, the current module stays attached without the probes.
+func (e *Exporter) enableMissingProbes(processFinder process.Finder, program config.Program, pid int) {
+	e.mu.RLock()
+	current, ok := e.modules[program.Name][pid]
+	currentContext := e.usdtContexts[program.Name][pid]
+	e.mu.RUnlock()
+	if !ok {
+		return
+	}
+	zap.S().Infof("Missing usdt probes of program %s became available in pid %d, enabling them", program.Name, pid)
+	proc, err := processFinder.Proc(pid)
+	if err != nil {
+		return
+	}
+	if err := e.attachProc(program, proc); err != nil {
+		stage := e.countAttachError(program.Name, pid, err)
+		zap.S().Errorf("Error enabling the missing usdt probes of program %s in pid %d at stage %s, it stays attached without them: %s",
+			program.Name, pid, stage, err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if current == nil {
+		return
+	}
+	e.copyTablesLocked(program, current, e.modules[program.Name][pid])
+	current.Close()
+	if currentContext != nil {
+		currentContext.Close()
+	}
+}
+
+// copyTablesLocked copies every table the program's metrics are read from from one module to
+// the other. Counts for keys the destination already has are added to its own, since they
+// may come from the probes only it has; whatever fired while both modules were attached is
+// counted twice, which is preferred to losing counts. The caller must hold mu.
+func (e *Exporter) copyTablesLocked(program config.Program, from, to *bcc.Module) {
+	tables := []string{}
+	for _, counter := range program.Metrics.Counters {
+		tables = append(tables, counter.Table)
+	}
+	for _, histogram := range program.Metrics.Histograms {
+		tables = append(tables, histogram.Table)
+	}
+	for _, tableName := range tables {
+		source := bcc.NewTable(from.TableId(tableName), from)
+		destination := bcc.NewTable(to.TableId(tableName), to)
+		iter := source.Iter()
+		for iter.Next() {
+			leaf := iter.Leaf()
+			if existing, err := destination.Get(iter.Key()); err == nil {
+				leaf = addLeaves(leaf, existing)
+			}
+			if err := destination.Set(iter.Key(), leaf); err != nil {
+				zap.S().Debugf("Unable to copy table %s of program %s: %s", tableName, program.Name, err)
+			}
+		}
+	}
+}
+
+// addLeaves returns the sum of two values of a table, or the first one if they aren't 64 bit
+// counters. Histograms keep a counter per bucket, so they're added up the same way.
+func addLeaves(leaf, existing []byte) []byte {
+	if len(leaf) != 8 || len(existing) != 8 {
+		return leaf
+	}
+	order := bcc.GetHostByteOrder()
+	sum := make([]byte, 8)
+	order.PutUint64(sum, order.Uint64(leaf)+order.Uint64(existing))
+	return sum
+}
+
+// newFiles returns the files that weren't in the known set
+func newFiles(known, files map[string]bool) []string {
+	result := []string{}
+	for file := range files {
+		if !known[file] {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// declaresAnyProbe returns whether any of the process's files declares any of the usdt probes.
+// The files' notes are read directly, rather than through a usdt context for the whole process.
+func declaresAnyProbe(processFinder process.Finder, pid int, files []string, probes []string) bool {
+	for _, file := range files {
+		notes, err := usdt.ReadNotes(filepath.Join(processFinder.RootPath(pid), file))
+		if err != nil {
+			zap.S().Debugf("%s", err)
+			continue
+		}
+		for _, note := range notes {
+			for _, probe := range probes {
+				if note.Matches(probe) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package exporter
+
+import (
+	"errors"
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/procfs"
+	"reflect"
+	"testing"
+)
+
+// probesFixture is a binary declaring the usdt probes test:start and test:stop
+const probesFixture = "../usdt/testdata/probes-x86_64"
+
+func TestDeclaresAnyProbe(t *testing.T) {
+	procs := newFakeProcs(t)
+	procs.start(100, "app", 1)
+	procs.mapFile(100, "/usr/bin/app", "")
+	procs.mapFile(100, "/usr/lib/libprobes.so", probesFixture)
+	finder := procs.finder()
+
+	tests := []struct {
+		name     string
+		files    []string
+		probes   []string
+		expected bool
+	}{
+		{name: "declared probe", files: []string{"/usr/lib/libprobes.so"}, probes: []string{"test:missing", "test:stop"}, expected: true},
+		{name: "probe without provider", files: []string{"/usr/lib/libprobes.so"}, probes: []string{"start"}, expected: true},
+		{name: "undeclared probe", files: []string{"/usr/lib/libprobes.so"}, probes: []string{"other:start"}},
+		// Files that can't be read or have no notes are skipped
+		{name: "unreadable files", files: []string{"/usr/bin/app", "/usr/lib/gone.so", "/usr/lib/libprobes.so"}, probes: []string{"test:start"}, expected: true},
+		{name: "no new files", probes: []string{"test:start"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if declared := declaresAnyProbe(finder, 100, test.files, test.probes); declared != test.expected {
+				t.Errorf("Expected %t, got %t", test.expected, declared)
+			}
+		})
+	}
+}
+
+func TestNewFiles(t *testing.T) {
+	files := newFiles(map[string]bool{"/usr/bin/app": true}, map[string]bool{"/usr/bin/app": true, "/usr/lib/libprobes.so": true})
+	if expected := []string{"/usr/lib/libprobes.so"}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v, got %v", expected, files)
+	}
+}
+
+// attachWithMissingProbes attaches the program to the pid as if the probes weren't available,
+// when the process only had the given files mapped
+func attachWithMissingProbes(e *Exporter, program config.Program, pid int, files map[string]bool, probes ...string) *missingProbes {
+	missing := &missingProbes{probes: probes, files: files}
+	e.modules[program.Name] = map[int]*bcc.Module{pid: nil}
+	e.missingProbes[program.Name] = map[int]*missingProbes{pid: missing}
+	return missing
+}
+
+func TestRescanMissingProbes(t *testing.T) {
+	program := newTestProgram("app")
+	program.USDT = map[string]string{"test:start": "trace_start", "test:stop": "trace_stop"}
+	procs := newFakeProcs(t)
+	procs.start(100, "app", 1)
+	procs.start(101, "app", 1)
+	procs.mapFile(100, "/usr/bin/app", "")
+	procs.mapFile(101, "/usr/bin/app", "")
+	e, r := newTestExporter(program)
+	withProbes := attachWithMissingProbes(e, program, 100, map[string]bool{"/usr/bin/app": true}, "test:stop")
+	e.modules[program.Name][101] = nil
+	e.missingProbes[program.Name][101] = &missingProbes{probes: []string{"other:stop"}, files: map[string]bool{"/usr/bin/app": true}}
+
+	// Nothing new is mapped yet
+	e.rescanMissingProbes(procs.finder())
+	if calls := r.recorded(); len(calls) != 0 {
+		t.Fatalf("Expected nothing to be attached before a library is loaded, got %v", calls)
+	}
+
+	// Both processes load the library, but it only has the probes missing from the first one
+	procs.mapFile(100, "/usr/lib/libprobes.so", probesFixture)
+	procs.mapFile(101, "/usr/lib/libprobes.so", probesFixture)
+	e.rescanMissingProbes(procs.finder())
+	if expected := []string{"attach app 100"}; !reflect.DeepEqual(r.recorded(), expected) {
+		t.Errorf("Expected %v, got %v", expected, r.recorded())
+	}
+	// The library isn't scanned again once it's known
+	expectedFiles := map[string]bool{"/usr/bin/app": true, "/usr/lib/libprobes.so": true}
+	if !reflect.DeepEqual(withProbes.files, expectedFiles) {
+		t.Errorf("Expected the files to become %v, got %v", expectedFiles, withProbes.files)
+	}
+	if files := e.missingProbes[program.Name][101].files; !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Expected the files to become %v, got %v", expectedFiles, files)
+	}
+}
+
+func TestRescanMissingProbesSkipsExitedProcesses(t *testing.T) {
+	program := newTestProgram("app")
+	procs := newFakeProcs(t)
+	e, r := newTestExporter(program)
+	missing := attachWithMissingProbes(e, program, 100, map[string]bool{"/usr/bin/app": true}, "test:stop")
+	e.rescanMissingProbes(procs.finder())
+	if calls := r.recorded(); len(calls) != 0 {
+		t.Errorf("Expected nothing to be attached to an exited process, got %v", calls)
+	}
+	if expected := map[string]bool{"/usr/bin/app": true}; !reflect.DeepEqual(missing.files, expected) {
+		t.Errorf("Expected the files to stay %v, got %v", expected, missing.files)
+	}
+}
+
+func TestEnableMissingProbes(t *testing.T) {
+	program := newTestProgram("app")
+	procs := newFakeProcs(t)
+	procs.start(100, "app", 1)
+
+	t.Run("not attached", func(t *testing.T) {
+		e, r := newTestExporter(program)
+		e.enableMissingProbes(procs.finder(), program, 100)
+		if calls := r.recorded(); len(calls) != 0 {
+			t.Errorf("Expected nothing to be attached, got %v", calls)
+		}
+	})
+
+	t.Run("attached again", func(t *testing.T) {
+		e, r := newTestExporter(program)
+		attachWithMissingProbes(e, program, 100, map[string]bool{}, "test:stop")
+		e.enableMissingProbes(procs.finder(), program, 100)
+		if expected := []string{"attach app 100"}; !reflect.DeepEqual(r.recorded(), expected) {
+			t.Errorf("Expected %v, got %v", expected, r.recorded())
+		}
+	})
+
+	t.Run("failing to attach again", func(t *testing.T) {
+		e, _ := newTestExporter(program)
+		attachWithMissingProbes(e, program, 100, map[string]bool{}, "test:stop")
+		e.attachProc = func(program config.Program, proc procfs.Proc) error {
+			return &attachError{stageUSDTArguments, errors.New("bad arguments")}
+		}
+		e.enableMissingProbes(procs.finder(), program, 100)
+		if count := testutil.ToFloat64(e.attachErrors.WithLabelValues(program.Name, "100", stageUSDTArguments)); count != 1 {
+			t.Errorf("Expected the failure to be counted once, got %v", count)
+		}
+		// The program stays attached without the probes
+		if _, ok := e.modules[program.Name][100]; !ok {
+			t.Errorf("Expected the program to stay attached")
+		}
+	})
+}
+
+func TestAddLeaves(t *testing.T) {
+	order := bcc.GetHostByteOrder()
+	counter := func(value uint64) []byte {
+		data := make([]byte, 8)
+		order.PutUint64(data, value)
+		return data
+	}
+	if sum := addLeaves(counter(5), counter(3)); !reflect.DeepEqual(sum, counter(8)) {
+		t.Errorf("Expected the counters to add up to 8, got %d", order.Uint64(sum))
+	}
+	if leaf := addLeaves([]byte{1, 2, 3, 4}, []byte{5, 6, 7, 8}); !reflect.DeepEqual(leaf, []byte{1, 2, 3, 4}) {
+		t.Errorf("Expected values that aren't counters to be copied, got %v", leaf)
+	}
+}
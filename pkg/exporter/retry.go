@@ -0,0 +1,126 @@
+package exporter
+
+import (
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+// retryCheckInterval is how often attachments are checked for a retry being due
+const retryCheckInterval = time.Second
+
+// retryState tracks the failed attempts at attaching a program to a process
+type retryState struct {
+	// startTime is the start time of the process, so that a reused pid starts afresh
+	startTime      uint64
+	failedAttempts int
+	nextAttempt    time.Time
+	exhausted      bool
+}
+
+// shouldAttempt returns whether the program should be attached to the process now, or whether
+// it must wait for its backoff to expire first, or has given up altogether
+func (e *Exporter) shouldAttempt(programName string, pid int, startTime uint64, now time.Time) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	state, ok := e.retries[programName][pid]
+	if !ok || state.startTime != startTime {
+		return true
+	}
+	return !state.exhausted && !now.Before(state.nextAttempt)
+}
+
+// recordFailure schedules the next attempt at attaching the program to the process,
+// or gives up on it if it has run out of attempts
+func (e *Exporter) recordFailure(program config.Program, pid int, startTime uint64, now time.Time) {
+	policy := program.Retry.WithDefaults()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.retries[program.Name]; !ok {
+		e.retries[program.Name] = map[int]*retryState{}
+	}
+	state, ok := e.retries[program.Name][pid]
+	if !ok || state.startTime != startTime {
+		state = &retryState{startTime: startTime}
+		e.retries[program.Name][pid] = state
+	}
+	state.failedAttempts++
+	if state.failedAttempts >= policy.MaxAttempts {
+		state.exhausted = true
+		zap.S().Errorf("Giving up on attaching ebpf program %s to pid %d after %d attempts", program.Name, pid, state.failedAttempts)
+		return
+	}
+	backoff := policy.Backoff(state.failedAttempts)
+	state.nextAttempt = now.Add(backoff)
+	zap.S().Warnf("Retrying ebpf program %s for pid %d in %s (attempt %d of %d)", program.Name, pid, backoff, state.failedAttempts+1, policy.MaxAttempts)
+}
+
+// forgetRetries drops the retry state of the program for the process
+func (e *Exporter) forgetRetries(programName string, pid int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.retries[programName], pid)
+}
+
+// retryDue attempts again every attachment whose backoff has expired
+func (e *Exporter) retryDue(processFinder process.Finder) {
+	e.attachMu.Lock()
+	defer e.attachMu.Unlock()
+	now := time.Now()
+	due := map[string][]int{}
+	e.mu.RLock()
+	for programName, byPid := range e.retries {
+		for pid, state := range byPid {
+			if !state.exhausted && !now.Before(state.nextAttempt) {
+				due[programName] = append(due[programName], pid)
+			}
+		}
+	}
+	e.mu.RUnlock()
+	for _, program := range e.config.Programs {
+		for _, pid := range due[program.Name] {
+			if pid == systemWidePid {
+				e.attachToPath(program)
+				continue
+			}
+			proc, err := processFinder.Proc(pid)
+			if err != nil {
+				// The process is gone, and so is any reason to retry
+				e.forgetRetries(program.Name, pid)
+				continue
+			}
+			e.attachProgramToProcs(program, procfs.Procs{proc})
+		}
+	}
+}
+
+// reapRetries forgets the retry state of every process that is no longer running
+func (e *Exporter) reapRetries(processFinder process.Finder) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, byPid := range e.retries {
+		for pid, state := range byPid {
+			if pid != systemWidePid && !processFinder.IsRunning(pid, state.startTime) {
+				delete(byPid, pid)
+			}
+		}
+	}
+}
+
+// collectRetries sends the retry state of every process that failed to be attached to
+func (e *Exporter) collectRetries(ch chan<- prometheus.Metric) {
+	for programName, byPid := range e.retries {
+		for pid, state := range byPid {
+			exhausted := 0.0
+			if state.exhausted {
+				exhausted = 1
+			}
+			ch <- prometheus.MustNewConstMetric(e.attachFailedAttemptsDesc, prometheus.GaugeValue, float64(state.failedAttempts), programName, strconv.Itoa(pid))
+			ch <- prometheus.MustNewConstMetric(e.attachRetriesExhaustedDesc, prometheus.GaugeValue, exhausted, programName, strconv.Itoa(pid))
+		}
+	}
+}
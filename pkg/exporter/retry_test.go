@@ -0,0 +1,185 @@
+package exporter
+
+import (
+	"errors"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/procfs"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newRetryProgram returns a program that retries with the given policy
+func newRetryProgram(maxAttempts int) config.Program {
+	program := newTestProgram("python")
+	program.Retry = config.Retry{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second, MaxAttempts: maxAttempts}
+	return program
+}
+
+func TestRecordFailureBacksOff(t *testing.T) {
+	program := newRetryProgram(10)
+	e, _ := newTestExporter(program)
+	now := time.Unix(1000, 0)
+	if !e.shouldAttempt(program.Name, 100, 1, now) {
+		t.Fatalf("Expected a process that never failed to be attempted")
+	}
+	// The backoff doubles after every failure, up to the maximum
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		e.recordFailure(program, 100, 1, now)
+		if e.shouldAttempt(program.Name, 100, 1, now.Add(backoff-time.Millisecond)) {
+			t.Errorf("Expected no attempt before the backoff of %s expires", backoff)
+		}
+		if !e.shouldAttempt(program.Name, 100, 1, now.Add(backoff)) {
+			t.Errorf("Expected an attempt once the backoff of %s expires", backoff)
+		}
+		now = now.Add(backoff)
+	}
+	// Other processes aren't held back
+	if !e.shouldAttempt(program.Name, 101, 1, now) {
+		t.Errorf("Expected another process to be attempted")
+	}
+}
+
+func TestRecordFailureGivesUp(t *testing.T) {
+	program := newRetryProgram(3)
+	e, _ := newTestExporter(program)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		e.recordFailure(program, 100, 1, now)
+	}
+	state := e.retries[program.Name][100]
+	if !state.exhausted || state.failedAttempts != 3 {
+		t.Fatalf("Expected to give up after 3 attempts, got %+v", state)
+	}
+	if e.shouldAttempt(program.Name, 100, 1, now.Add(time.Hour)) {
+		t.Errorf("Expected no more attempts once given up")
+	}
+}
+
+func TestRecordFailureResetsReusedPid(t *testing.T) {
+	program := newRetryProgram(2)
+	e, _ := newTestExporter(program)
+	now := time.Unix(1000, 0)
+	e.recordFailure(program, 100, 1, now)
+	e.recordFailure(program, 100, 1, now)
+	// The pid now belongs to a process started later
+	if !e.shouldAttempt(program.Name, 100, 2, now) {
+		t.Errorf("Expected a new process with a reused pid to be attempted")
+	}
+	e.recordFailure(program, 100, 2, now)
+	if state := e.retries[program.Name][100]; state.exhausted || state.failedAttempts != 1 || state.startTime != 2 {
+		t.Errorf("Expected the new process to start afresh, got %+v", state)
+	}
+}
+
+func TestAttachProgramToProcsRetries(t *testing.T) {
+	program := newRetryProgram(2)
+	procs := newFakeProcs(t)
+	procs.start(100, "python", 1)
+	proc, err := procs.finder().Proc(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := newTestExporter(program)
+	attempts := 0
+	e.attachProc = func(program config.Program, proc procfs.Proc) error {
+		attempts++
+		return errors.New("no such symbol")
+	}
+	e.attachProgramToProcs(program, procfs.Procs{proc})
+	// Still backing off
+	e.attachProgramToProcs(program, procfs.Procs{proc})
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt within the backoff, got %d", attempts)
+	}
+	e.retries[program.Name][100].nextAttempt = time.Time{}
+	e.attachProgramToProcs(program, procfs.Procs{proc})
+	e.retries[program.Name][100].nextAttempt = time.Time{}
+	e.attachProgramToProcs(program, procfs.Procs{proc})
+	if attempts != 2 {
+		t.Errorf("Expected to give up after 2 attempts, got %d", attempts)
+	}
+}
+
+func TestReapRetries(t *testing.T) {
+	program := newRetryProgram(5)
+	procs := newFakeProcs(t)
+	procs.start(100, "python", 1)
+	procs.start(101, "python", 5)
+	e, _ := newTestExporter(program)
+	now := time.Unix(1000, 0)
+	e.recordFailure(program, 100, 1, now)
+	// The pid was reused by a process started later
+	e.recordFailure(program, 101, 1, now)
+	// The process exited
+	e.recordFailure(program, 102, 1, now)
+	// Attaching by path isn't tied to a process
+	e.recordFailure(program, systemWidePid, 0, now)
+
+	e.reapRetries(procs.finder())
+	pids := map[int]bool{}
+	for pid := range e.retries[program.Name] {
+		pids[pid] = true
+	}
+	if expected := map[int]bool{100: true, systemWidePid: true}; !reflect.DeepEqual(pids, expected) {
+		t.Errorf("Expected the retries of %v to be kept, got %v", expected, pids)
+	}
+}
+
+func TestRetryDueForgetsExitedProcesses(t *testing.T) {
+	program := newRetryProgram(5)
+	procs := newFakeProcs(t)
+	procs.start(100, "python", 1)
+	e, r := newTestExporter(program)
+	past := time.Now().Add(-time.Hour)
+	e.recordFailure(program, 100, 1, past)
+	e.recordFailure(program, 101, 1, past)
+
+	e.retryDue(procs.finder())
+	if expected := []string{"attach python 100"}; !reflect.DeepEqual(r.recorded(), expected) {
+		t.Errorf("Expected %v, got %v", expected, r.recorded())
+	}
+	if len(e.retries[program.Name]) != 0 {
+		t.Errorf("Expected the retries to be forgotten, got %v", e.retries[program.Name])
+	}
+}
+
+func TestCollectRetries(t *testing.T) {
+	program := newRetryProgram(2)
+	e, _ := newTestExporter(program)
+	now := time.Unix(1000, 0)
+	e.recordFailure(program, 100, 1, now)
+	e.recordFailure(program, 101, 1, now)
+	e.recordFailure(program, 101, 1, now)
+
+	ch := make(chan prometheus.Metric, 10)
+	e.collectRetries(ch)
+	close(ch)
+	names := map[*prometheus.Desc]string{
+		e.attachFailedAttemptsDesc:   "failed_attempts",
+		e.attachRetriesExhaustedDesc: "retries_exhausted",
+	}
+	values := map[string]float64{}
+	for metric := range ch {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		key := names[metric.Desc()]
+		for _, label := range m.Label {
+			key += " " + label.GetName() + "=" + label.GetValue()
+		}
+		values[key] = m.GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"failed_attempts pid=100 program=python":   1,
+		"retries_exhausted pid=100 program=python": 0,
+		"failed_attempts pid=101 program=python":   2,
+		"retries_exhausted pid=101 program=python": 1,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+}
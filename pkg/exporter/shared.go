@@ -0,0 +1,341 @@
+package exporter
+
+import (
+	"fmt"
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/uprobe"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/usdt"
+	"github.com/prometheus/procfs"
+	"go.uber.org/zap"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// systemWidePid is the pid that programs attached by path are attached to, which the kernel
+// takes to mean every process
+const systemWidePid = -1
+
+// pidLabel is the label programs with a shared module declare to tell processes apart in their maps
+const pidLabel = config.PidLabel
+
+// attachSharedProgramToProc attaches the program's shared module to the process, compiling
+// it first if this is the first process it's attached to. If attaching fails, the uprobes
+// attached up to that point are detached, but the module is kept for the next process.
+func (e *Exporter) attachSharedProgramToProc(program config.Program, proc procfs.Proc) error {
+	pid := proc.PID
+	stat, err := proc.Stat()
+	if err != nil {
+		return &attachError{stageProcess, fmt.Errorf("Unable to get start time for pid %d: %w", pid, err)}
+	}
+	executablePath, err := process.ExecutablePath(proc)
+	if err != nil {
+		return &attachError{stageProcess, err}
+	}
+	module, probes, _, err := e.attachSharedModule(program, executablePath, pid)
+	if err != nil {
+		return err
+	}
+	zap.S().Infof("Program %s attached to pid %d", program.Name, pid)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.addSharedLocked(program.Name, pid, module, probes)
+	e.startTimes[pid] = stat.Starttime
+	return nil
+}
+
+// attachProgramByPath attaches the program to every process running its attachment's path,
+// returning an error only if the program is required and couldn't be attached
+func (e *Exporter) attachProgramByPath(program config.Program) error {
+	others := program.Attachment
+	others.Path = ""
+	if !reflect.DeepEqual(others, config.Attachment{}) {
+		err := fmt.Errorf("Attachment of ebpf program %s sets path, so it can't have any other selectors", program.Name)
+		if program.Required {
+			return err
+		}
+		zap.S().Errorf("%s; the program will be pending", err)
+		return nil
+	}
+	if !e.attachToPath(program) && program.Required {
+		return fmt.Errorf("Unable to attach ebpf program %s to %s", program.Name, program.Attachment.Path)
+	}
+	return nil
+}
+
+// attachToPath attaches the program to every process running its attachment's path, unless
+// it's attached already or is waiting to be retried. Returns whether the program is attached.
+func (e *Exporter) attachToPath(program config.Program) bool {
+	if e.isAttached(program.Name, systemWidePid) {
+		return true
+	}
+	// There's no process whose restart could reset the retries, so they're tracked under
+	// the system-wide pid with a start time that never changes
+	now := time.Now()
+	if !e.shouldAttempt(program.Name, systemWidePid, 0, now) {
+		return false
+	}
+	module, probes, usdtContext, err := e.attachSharedModule(program, program.Attachment.Path, systemWidePid)
+	if err != nil {
+		stage := e.countAttachError(program.Name, systemWidePid, err)
+		zap.S().Errorf("Error attaching ebpf program %s to %s at stage %s: %s", program.Name, program.Attachment.Path, stage, err)
+		e.recordFailure(program, systemWidePid, 0, now)
+		return false
+	}
+	e.forgetRetries(program.Name, systemWidePid)
+	zap.S().Infof("Program %s attached to %s for every process", program.Name, program.Attachment.Path)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.addSharedLocked(program.Name, systemWidePid, module, probes)
+	if usdtContext != nil {
+		if _, ok := e.usdtContexts[program.Name]; !ok {
+			e.usdtContexts[program.Name] = make(map[int]*usdt.Context)
+		}
+		e.usdtContexts[program.Name][systemWidePid] = usdtContext
+	}
+	return true
+}
+
+// detachable is a uprobe that can be detached by itself
+type detachable interface {
+	Close()
+}
+
+// uprobeAttacher loads the uprobe programs of a module and attaches them one uprobe at a time,
+// so that they can be detached from a single process. It's only replaced in tests.
+type uprobeAttacher struct {
+	load          func(module *bcc.Module, name string) (int, error)
+	attach        func(probeType uprobe.Type, name, symbol string, fd, pid int) (detachable, error)
+	attachAddress func(probeType uprobe.Type, name string, address uint64, fd, pid int) (detachable, error)
+}
+
+// bccUprobeAttacher attaches uprobes for real
+var bccUprobeAttacher = uprobeAttacher{
+	load: func(module *bcc.Module, name string) (int, error) {
+		return module.LoadUprobe(name)
+	},
+	attach: func(probeType uprobe.Type, name, symbol string, fd, pid int) (detachable, error) {
+		probe, err := uprobe.Attach(probeType, name, symbol, fd, pid)
+		if err != nil {
+			return nil, err
+		}
+		return probe, nil
+	},
+	attachAddress: func(probeType uprobe.Type, name string, address uint64, fd, pid int) (detachable, error) {
+		probe, err := uprobe.AttachAddress(probeType, name, address, fd, pid)
+		if err != nil {
+			return nil, err
+		}
+		return probe, nil
+	},
+}
+
+// attachSharedModule attaches the probes of the program's shared module for the pid, or for
+// every process if the pid is -1, compiling the module first if it hasn't been.
+// If attaching fails, the uprobes attached up to that point are detached, but the module is
+// kept for the next attempt, unless it has usdt probes.
+// Only programs attached for every process can have usdt probes, whose context is returned.
+func (e *Exporter) attachSharedModule(program config.Program, executablePath string, pid int) (*bcc.Module, []detachable, *usdt.Context, error) {
+	code := program.Code
+	var usdtContext *usdt.Context
+	if len(program.USDT) > 0 {
+		if pid != systemWidePid {
+			// The usdt arguments are generated for a specific process, and compiled into the module
+			return nil, nil, nil, &attachError{stageUSDTContext, fmt.Errorf("Program %s has usdt probes, so it can't share a module", program.Name)}
+		}
+		var err error
+		usdtContext, code, err = e.enableUSDTFromPath(program, executablePath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	probes := []detachable{}
+	// fail undoes everything attached so far
+	fail := func(err error) (*bcc.Module, []detachable, *usdt.Context, error) {
+		for _, probe := range probes {
+			probe.Close()
+		}
+		if usdtContext != nil {
+			usdtContext.Close()
+			// The usdt uprobes are owned by the module, so it's the only way to detach them
+			e.dropSharedModule(program.Name)
+		}
+		return nil, nil, nil, err
+	}
+	module, err := e.sharedModule(program, code)
+	if err != nil {
+		return fail(err)
+	}
+	if usdtContext != nil {
+		if err := usdtContext.AttachUprobes(module); err != nil {
+			return fail(&attachError{stageUSDTAttach, fmt.Errorf("Unable to attach USDT uprobes for program %s: %w", program.Name, err)})
+		}
+	}
+	keep := func(probe detachable, err error) error {
+		if err != nil {
+			return err
+		}
+		probes = append(probes, probe)
+		return nil
+	}
+	attacher := func(probeType uprobe.Type) func(string, string, int, int) error {
+		return func(name, symbol string, fd, pid int) error {
+			return keep(e.uprobeAttacher.attach(probeType, name, symbol, fd, pid))
+		}
+	}
+	addressAttacher := func(name string, address uint64, fd, pid int) error {
+		return keep(e.uprobeAttacher.attachAddress(uprobe.Entry, name, address, fd, pid))
+	}
+	loader := func(name string) (int, error) {
+		return e.uprobeAttacher.load(module, name)
+	}
+	if err := e.attachProbesToProc(program.Uprobes, program.ProbeSymbolLimit(), executablePath, pid, loader, attacher(uprobe.Entry), addressAttacher); err != nil {
+		return fail(&attachError{stageUprobeAttach, fmt.Errorf("Unable to attach uprobes for program %s: %w", program.Name, err)})
+	}
+	if err := e.attachProbesToProc(program.Uretprobes, program.ProbeSymbolLimit(), executablePath, pid, loader, attacher(uprobe.Return), nil); err != nil {
+		return fail(&attachError{stageUretprobeAttach, fmt.Errorf("Unable to attach uretprobes for program %s: %w", program.Name, err)})
+	}
+	if err := e.attachGoUretprobes(program.GoUretprobes, executablePath, pid, loader, addressAttacher); err != nil {
+		return fail(&attachError{stageGoUretprobe, fmt.Errorf("Unable to attach go uretprobes for program %s: %w", program.Name, err)})
+	}
+	return module, probes, usdtContext, nil
+}
+
+// enableUSDTFromPath enables the program's usdt probes in the binary or library at path, for
+// every process that runs it, returning the context along with the program's code augmented
+// with the usdt arguments
+func (e *Exporter) enableUSDTFromPath(program config.Program, path string) (*usdt.Context, string, error) {
+	if err := checkUSDTMetricArguments(program, []string{path}); err != nil {
+		return nil, "", err
+	}
+	usdtContext, err := usdt.NewContextFromPath(path)
+	if err != nil {
+		return nil, "", &attachError{stageUSDTContext, fmt.Errorf("Can't initialize usdt context for %s: %w", program.Name, err)}
+	}
+	for probe, fnName := range program.USDT {
+		if err := usdtContext.EnableProbe(probe, fnName); err != nil {
+			usdtContext.Close()
+			return nil, "", &attachError{stageUSDTEnable, err}
+		}
+	}
+	code, err := usdtContext.AddUSDTArguments(program.Code)
+	if err != nil {
+		usdtContext.Close()
+		return nil, "", &attachError{stageUSDTArguments, fmt.Errorf("Unable to add usdt arguments for program %s: %w", program.Name, err)}
+	}
+	return usdtContext, code, nil
+}
+
+// addSharedLocked records that the program's shared module is attached to the pid through
+// the given uprobes. The caller must hold mu.
+func (e *Exporter) addSharedLocked(programName string, pid int, module *bcc.Module, probes []detachable) {
+	if _, ok := e.modules[programName]; !ok {
+		e.modules[programName] = make(map[int]*bcc.Module)
+	}
+	if _, ok := e.sharedProbes[programName]; !ok {
+		e.sharedProbes[programName] = make(map[int][]detachable)
+	}
+	e.modules[programName][pid] = module
+	e.sharedProbes[programName][pid] = probes
+}
+
+// sharedModule returns the program's shared module, compiling the code if it hasn't been yet
+func (e *Exporter) sharedModule(program config.Program, code string) (*bcc.Module, error) {
+	e.mu.RLock()
+	module, ok := e.sharedModules[program.Name]
+	e.mu.RUnlock()
+	if ok {
+		return module, nil
+	}
+	module, err := e.compile(program, code)
+	if err != nil {
+		return nil, err
+	}
+	zap.S().Infof("Compiled shared module for program %s", program.Name)
+	e.mu.Lock()
+	e.sharedModules[program.Name] = module
+	e.mu.Unlock()
+	return module, nil
+}
+
+// dropSharedModule closes the program's shared module, so that it's compiled again the next time it's needed
+func (e *Exporter) dropSharedModule(programName string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if module, ok := e.sharedModules[programName]; ok {
+		module.Close()
+		delete(e.sharedModules, programName)
+	}
+}
+
+// dropPidKeysLocked deletes the keys of the pid from the maps of the program's shared module,
+// for every metric with a pid label, so that the series of a process that's gone aren't
+// exported forever. Metrics without a pid label keep what every process did, including the
+// ones that are gone. The caller must hold mu.
+func (e *Exporter) dropPidKeysLocked(programName string, pid int, module *bcc.Module) {
+	for _, program := range e.config.Programs {
+		if program.Name != programName {
+			continue
+		}
+		for _, counter := range program.Metrics.Counters {
+			e.dropPidKeys(module, counter.Table, counter.Labels, pid)
+		}
+		for _, histogram := range program.Metrics.Histograms {
+			e.dropPidKeys(module, histogram.Table, histogram.Labels, pid)
+		}
+	}
+}
+
+// dropPidKeys deletes the keys of the pid from the table, if its labels have a pid label
+func (e *Exporter) dropPidKeys(module *bcc.Module, tableName string, labels []ebpf_config.Label, pid int) {
+	if _, _, ok := findPidLabel(labels); !ok {
+		return
+	}
+	table := bcc.NewTable(module.TableId(tableName), module)
+	keys := [][]byte{}
+	iter := table.Iter()
+	for iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+	}
+	// Keys are only deleted once they've all been read, since deleting them while iterating
+	// would make the iterator start over
+	for _, key := range e.pidKeys(keys, labels, pid) {
+		if err := table.Delete(key); err != nil {
+			zap.S().Debugf("Unable to delete key of pid %d from table %s: %s", pid, tableName, err)
+		}
+	}
+}
+
+// pidKeys returns the keys whose pid label is the pid
+func (e *Exporter) pidKeys(keys [][]byte, labels []ebpf_config.Label, pid int) [][]byte {
+	label, offset, ok := findPidLabel(labels)
+	if !ok {
+		return nil
+	}
+	matching := [][]byte{}
+	for _, key := range keys {
+		if uint(len(key)) < offset+label.Size {
+			continue
+		}
+		value, err := e.decoders.Decode(key[offset:offset+label.Size], label)
+		if err == nil && string(value) == strconv.Itoa(pid) {
+			matching = append(matching, key)
+		}
+	}
+	return matching
+}
+
+// findPidLabel returns the pid label of a table with the labels, and where it starts in its keys
+func findPidLabel(labels []ebpf_config.Label) (ebpf_config.Label, uint, bool) {
+	offset := uint(0)
+	for _, label := range labels {
+		if label.Name == pidLabel {
+			return label, offset, true
+		}
+		offset += label.Size
+	}
+	return ebpf_config.Label{}, 0, false
+}
@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	ebpf_config "github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/uprobe"
+	"github.com/prometheus/procfs"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPidKeys(t *testing.T) {
+	e, _ := newTestExporter()
+	uint32Label := func(name string) ebpf_config.Label {
+		return ebpf_config.Label{Name: name, Size: 4, Decoders: []ebpf_config.Decoder{{Name: "uint"}}}
+	}
+	key := func(gen, pid uint32) []byte {
+		data := make([]byte, 8)
+		bcc.GetHostByteOrder().PutUint32(data, gen)
+		bcc.GetHostByteOrder().PutUint32(data[4:], pid)
+		return data
+	}
+	keys := [][]byte{key(0, 100), key(1, 100), key(0, 101), key(100, 102)}
+
+	matching := e.pidKeys(keys, []ebpf_config.Label{uint32Label("gen"), uint32Label(pidLabel)}, 100)
+	if expected := [][]byte{key(0, 100), key(1, 100)}; !reflect.DeepEqual(matching, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, matching)
+	}
+	if matching := e.pidKeys(keys, []ebpf_config.Label{uint32Label("gen"), uint32Label("worker")}, 100); len(matching) != 0 {
+		t.Errorf("Expected no keys without a pid label, got %v", matching)
+	}
+}
+
+// fakeProbe is an attached uprobe that records being detached
+type fakeProbe struct {
+	symbol string
+	closed bool
+}
+
+func (p *fakeProbe) Close() {
+	p.closed = true
+}
+
+func TestAttachSharedModuleDetachesOnFailure(t *testing.T) {
+	program := newTestProgram("python")
+	program.Uprobes = map[string]string{"main": "trace_entry", "libc.so.6:malloc": "trace_malloc"}
+	program.Uretprobes = map[string]string{"main": "trace_return"}
+	e, _ := newTestExporter(program)
+	// A module that's already compiled is reused, so nothing is compiled
+	e.sharedModules[program.Name] = nil
+	attached := []*fakeProbe{}
+	e.uprobeAttacher = uprobeAttacher{
+		load: func(module *bcc.Module, name string) (int, error) {
+			return 3, nil
+		},
+		attach: func(probeType uprobe.Type, name, symbol string, fd, pid int) (detachable, error) {
+			if probeType == uprobe.Return {
+				return nil, errors.New("uretprobes unsupported")
+			}
+			probe := &fakeProbe{symbol: symbol}
+			attached = append(attached, probe)
+			return probe, nil
+		},
+	}
+
+	module, probes, usdtContext, err := e.attachSharedModule(program, "/usr/bin/python", systemWidePid)
+	var attachErr *attachError
+	if !errors.As(err, &attachErr) || attachErr.stage != stageUretprobeAttach {
+		t.Fatalf("Expected the uretprobes to fail to attach, got %v", err)
+	}
+	if module != nil || probes != nil || usdtContext != nil {
+		t.Errorf("Expected nothing to be returned on failure, got %v, %v, %v", module, probes, usdtContext)
+	}
+	if len(attached) != 2 {
+		t.Fatalf("Expected both uprobes to be attached before the uretprobe, got %d", len(attached))
+	}
+	for _, probe := range attached {
+		if !probe.closed {
+			t.Errorf("Expected the uprobe on %s to be detached", probe.symbol)
+		}
+	}
+	if _, ok := e.sharedModules[program.Name]; !ok {
+		t.Errorf("Expected the module to be kept for the next attempt")
+	}
+}
+
+const benchmarkCode = `
+#include <uapi/linux/ptrace.h>
+
+BPF_HASH(calls, u32);
+
+int trace_call(struct pt_regs *ctx) {
+    u32 pid = bpf_get_current_pid_tgid() >> 32;
+    calls.increment(pid);
+    return 0;
+}
+`
+
+// startSleepers starts processes that sleep until the benchmark is done, and waits for them
+// to load libc
+func startSleepers(b *testing.B, count int) procfs.Procs {
+	finder, err := process.NewFinder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	procs := procfs.Procs{}
+	for i := 0; i < count; i++ {
+		cmd := exec.Command("sleep", "3600")
+		if err := cmd.Start(); err != nil {
+			b.Skipf("Unable to start sleep: %s", err)
+		}
+		b.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		for attempt := 0; ; attempt++ {
+			if _, err := process.ResolveLibrary(cmd.Process.Pid, "libc"); err == nil {
+				break
+			} else if attempt == 100 {
+				b.Fatalf("Sleep never loaded libc: %s", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		proc, err := finder.Proc(cmd.Process.Pid)
+		if err != nil {
+			b.Fatal(err)
+		}
+		procs = append(procs, proc)
+	}
+	return procs
+}
+
+// BenchmarkAttach compares how long attaching a program to several processes takes, with a
+// module compiled for each process and with a single shared module. Every iteration starts
+// from a new exporter, so the shared module is compiled once per iteration.
+// Attaching needs root and a working bcc, so the benchmark is skipped without them, as it
+// is in CI.
+func BenchmarkAttach(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("Attaching programs needs root")
+	}
+	for _, processes := range []int{1, 8, 32} {
+		procs := startSleepers(b, processes)
+		for _, shared := range []bool{false, true} {
+			program := newTestProgram("sleep")
+			program.Code = benchmarkCode
+			program.Uprobes = map[string]string{"libc:clock_nanosleep": "trace_call"}
+			program.SharedModule = shared
+			name := fmt.Sprintf("per_pid/%d", processes)
+			if shared {
+				name = fmt.Sprintf("shared/%d", processes)
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					e := New(config.Config{Programs: []config.Program{program}})
+					for _, proc := range procs {
+						if err := e.attachProgramToProc(program, proc); err != nil {
+							b.Skipf("Unable to attach with bcc: %s", err)
+						}
+					}
+					b.StopTimer()
+					for _, proc := range procs {
+						e.detachPid(proc.PID)
+					}
+					e.dropSharedModule(program.Name)
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/usdt"
+	"go.uber.org/zap"
+	"path/filepath"
+)
+
+// checkUSDTMetricArguments checks that the probes of the program's usdt metrics have every
+// argument the metrics read, according to the USDT notes of the files. bcc can't tell that an
+// argument doesn't exist, it just fails to read it at runtime, leaving the labels empty.
+// Probes that no file has a note for, such as ones in libraries that aren't loaded yet, aren't
+// checked.
+func checkUSDTMetricArguments(program config.Program, paths []string) error {
+	if len(program.USDTMetrics) == 0 {
+		return nil
+	}
+	notes := []usdt.Note{}
+	for _, path := range paths {
+		fileNotes, err := usdt.ReadNotes(path)
+		if err != nil {
+			zap.S().Debugf("%s", err)
+			continue
+		}
+		notes = append(notes, fileNotes...)
+	}
+	for _, metric := range program.USDTMetrics {
+		needed := metric.ValueArgument
+		for _, label := range metric.Labels {
+			if label.Argument > needed {
+				needed = label.Argument
+			}
+		}
+		for _, note := range notes {
+			if note.Matches(metric.Probe) && len(note.Arguments) < needed {
+				return &attachError{stageUSDTArguments, fmt.Errorf("Metric %s of program %s reads argument %d of probe %s, which only has %d",
+					metric.Name, program.Name, needed, note, len(note.Arguments))}
+			}
+		}
+	}
+	return nil
+}
+
+// mappedPaths returns the paths the files mapped by the process can be opened at from our
+// mount namespace, or nothing if they can't be read
+func mappedPaths(pid int) []string {
+	files, err := process.MappedFiles(pid)
+	if err != nil {
+		zap.S().Debugf("%s", err)
+		return nil
+	}
+	paths := make([]string, 0, len(files))
+	for file := range files {
+		paths = append(paths, filepath.Join(process.RootPath(pid), file))
+	}
+	return paths
+}
@@ -0,0 +1,44 @@
+package exporter
+
+import (
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"testing"
+)
+
+func TestCheckUSDTMetricArguments(t *testing.T) {
+	// test:start has 5 arguments and test:stop none
+	paths := []string{"../usdt/testdata/probes-x86_64"}
+	metric := func(probe string, valueArgument int, arguments ...int) config.Program {
+		program := newTestProgram("python")
+		usdtMetric := config.USDTMetric{Probe: probe, Name: "calls", ValueArgument: valueArgument}
+		for _, argument := range arguments {
+			usdtMetric.Labels = append(usdtMetric.Labels, config.USDTLabel{Name: "label", Argument: argument})
+		}
+		program.USDTMetrics = []config.USDTMetric{usdtMetric}
+		return program
+	}
+	tests := []struct {
+		name    string
+		program config.Program
+		valid   bool
+	}{
+		{name: "every argument", program: metric("test:start", 5, 1, 2), valid: true},
+		{name: "bare probe name", program: metric("start", 0, 5), valid: true},
+		{name: "label past the last argument", program: metric("test:start", 0, 1, 6)},
+		{name: "value past the last argument", program: metric("start", 6, 1)},
+		{name: "probe without arguments", program: metric("test:stop", 0, 1)},
+		{name: "probe in no file", program: metric("test:missing", 0, 12), valid: true},
+		{name: "no usdt metrics", program: newTestProgram("python"), valid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkUSDTMetricArguments(test.program, paths)
+			if test.valid && err != nil {
+				t.Errorf("Expected no error, got %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package process
+
+import (
+	"fmt"
+	"github.com/prometheus/procfs"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// containerIDRegexp matches the container IDs used by docker, containerd and cri-o
+var containerIDRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// matchesCgroup returns whether the process belongs to a cgroup matching the selector.
+// A selector starting with a / is a cgroup path prefix, anything else is a container ID,
+// which may be abbreviated, and may carry a runtime prefix such as containerd://
+// Both cgroup v1, where a process has a cgroup per hierarchy, and v2 are supported.
+func (f Finder) matchesCgroup(proc procfs.Proc, selector string) (bool, error) {
+	paths, err := f.cgroupPaths(proc.PID)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		if strings.HasPrefix(selector, "/") {
+			if hasPathPrefix(path, selector) {
+				return true, nil
+			}
+			continue
+		}
+		if containerID := cgroupContainerID(path); containerID != "" && strings.HasPrefix(containerID, trimRuntimePrefix(selector)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cgroupPaths returns the path of every cgroup the process belongs to, from /proc/PID/cgroup.
+// It's read directly since procfs always reads it from /proc, whatever it was built for.
+func (f Finder) cgroupPaths(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.mountPoint, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get cgroups for process %d: %w", pid, err)
+	}
+	paths := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// Each line is hierarchy-ID:controller-list:cgroup-path, and the path may contain colons
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Unable to parse cgroup %q of process %d", line, pid)
+		}
+		paths = append(paths, fields[2])
+	}
+	return paths, nil
+}
+
+// hasPathPrefix returns whether prefix is path itself or one of its ancestors
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// cgroupContainerID returns the ID of the container a cgroup path belongs to, if any.
+// Depending on the runtime and cgroup driver, the ID is either a path component of its own
+// (/kubepods/burstable/pod.../<id>, /docker/<id>) or embedded in a systemd scope
+// (/system.slice/docker-<id>.scope, .../cri-containerd-<id>.scope, .../crio-<id>.scope).
+func cgroupContainerID(path string) string {
+	components := strings.Split(path, "/")
+	for i := len(components) - 1; i >= 0; i-- {
+		component := strings.TrimSuffix(components[i], ".scope")
+		if index := strings.LastIndex(component, "-"); index >= 0 {
+			component = component[index+1:]
+		}
+		if containerIDRegexp.MatchString(component) {
+			return component
+		}
+	}
+	return ""
+}
+
+// trimRuntimePrefix removes the runtime prefix kubernetes reports container IDs with
+func trimRuntimePrefix(containerID string) string {
+	if index := strings.Index(containerID, "://"); index >= 0 {
+		return containerID[index+3:]
+	}
+	return containerID
+}
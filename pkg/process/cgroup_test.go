@@ -0,0 +1,87 @@
+package process
+
+import (
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	containerA = "3f4e2a1b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f"
+	containerB = "3f4e2a1b00000000000000000000000000000000000000000000000000000000"
+)
+
+func TestCgroupContainerID(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "/docker/" + containerA, expected: containerA},
+		{path: "/kubepods/burstable/pod0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d/" + containerA, expected: containerA},
+		{path: "/system.slice/docker-" + containerA + ".scope", expected: containerA},
+		{path: "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0a1b2c3d.slice/cri-containerd-" + containerA + ".scope", expected: containerA},
+		{path: "/kubepods.slice/kubepods-besteffort.slice/crio-" + containerA + ".scope", expected: containerA},
+		{path: "/user.slice/user-1000.slice/session-2.scope"},
+		{path: "/"},
+		// Too short to be a container ID
+		{path: "/docker/3f4e2a1b5c6d"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if id := cgroupContainerID(test.path); id != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, id)
+			}
+		})
+	}
+}
+
+func TestCgroup(t *testing.T) {
+	procs := newFakeProcFS(t)
+	// cgroup v1, with a cgroup per hierarchy
+	procs.add(fakeProc{pid: 100, comm: "python3", cgroup: strings.Join([]string{
+		"12:memory:/kubepods/burstable/pod0a1b2c3d/" + containerA,
+		"11:cpu,cpuacct:/kubepods/burstable/pod0a1b2c3d/" + containerA,
+		"1:name=systemd:/kubepods/burstable/pod0a1b2c3d/" + containerA,
+	}, "\n") + "\n"})
+	// cgroup v2, with a single unified hierarchy
+	procs.add(fakeProc{pid: 101, comm: "python3", cgroup: "0::/system.slice/docker-" + containerB + ".scope\n"})
+	procs.add(fakeProc{pid: 102, comm: "sshd", cgroup: "0::/system.slice/sshd.service\n"})
+	finder := procs.finder()
+
+	tests := []struct {
+		cgroup   string
+		expected []int
+	}{
+		{cgroup: containerA, expected: []int{100}},
+		{cgroup: "docker://" + containerB, expected: []int{101}},
+		{cgroup: "containerd://" + containerA, expected: []int{100}},
+		// Abbreviated IDs are prefixes of the full one
+		{cgroup: containerA[:12], expected: []int{100}},
+		{cgroup: "3f4e2a1b", expected: []int{100, 101}},
+		{cgroup: "4e2a1b", expected: []int{}},
+		{cgroup: "/kubepods", expected: []int{100}},
+		{cgroup: "/kubepods/burstable/", expected: []int{100}},
+		// A path prefix only matches whole components
+		{cgroup: "/kube", expected: []int{}},
+		{cgroup: "/system.slice", expected: []int{101, 102}},
+		{cgroup: "/system.slice/sshd.service", expected: []int{102}},
+	}
+	for _, test := range tests {
+		t.Run(test.cgroup, func(t *testing.T) {
+			if pids := findPids(t, finder, config.Attachment{Cgroup: test.cgroup}); !reflect.DeepEqual(pids, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, pids)
+			}
+		})
+	}
+}
+
+func TestCgroupRejectsEmptyContainerID(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "python3", cgroup: "0::/docker/" + containerA + "\n"})
+	for _, cgroup := range []string{"docker://", "containerd://"} {
+		if _, err := procs.finder().Find(config.Attachment{Cgroup: cgroup}); err == nil {
+			t.Errorf("Expected %s to be rejected rather than match every container", cgroup)
+		}
+	}
+}
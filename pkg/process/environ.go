@@ -0,0 +1,59 @@
+package process
+
+import (
+	"fmt"
+	"github.com/prometheus/procfs"
+	"regexp"
+	"strings"
+)
+
+// envSelector matches the environment a process was started with
+type envSelector struct {
+	values  map[string]string
+	regexes map[string]*regexp.Regexp
+}
+
+// newEnvSelector prepares the env and env_regex selectors of an attachment for matching
+func newEnvSelector(values, regexes map[string]string) (*envSelector, error) {
+	if len(values) == 0 && len(regexes) == 0 {
+		return nil, nil
+	}
+	s := &envSelector{
+		values:  values,
+		regexes: make(map[string]*regexp.Regexp, len(regexes)),
+	}
+	for key, expression := range regexes {
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid env_regex %q for %s: %w", expression, key, err)
+		}
+		s.regexes[key] = regex
+	}
+	return s, nil
+}
+
+// matches returns whether the process has every variable, with a matching value
+func (s *envSelector) matches(proc procfs.Proc) (bool, error) {
+	environ, err := proc.Environ()
+	if err != nil {
+		return false, fmt.Errorf("Unable to get environ for process %d: %w", proc.PID, err)
+	}
+	env := make(map[string]string, len(environ))
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	for key, expected := range s.values {
+		if value, ok := env[key]; !ok || value != expected {
+			return false, nil
+		}
+	}
+	for key, regex := range s.regexes {
+		if value, ok := env[key]; !ok || !regex.MatchString(value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
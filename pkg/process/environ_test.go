@@ -0,0 +1,50 @@
+package process
+
+import (
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"reflect"
+	"testing"
+)
+
+func TestEnv(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "python3", environ: []string{"SERVICE_NAME=billing", "ENV=prod", "EMPTY="}})
+	procs.add(fakeProc{pid: 101, comm: "python3", environ: []string{"SERVICE_NAME=billing-worker", "ENV=staging", "OPTS=a=b"}})
+	procs.add(fakeProc{pid: 102, comm: "python3", environ: []string{}})
+	// A process whose environment we can't read is skipped, rather than failing the whole scan
+	procs.add(fakeProc{pid: 103, comm: "python3", unreadableEnviron: true})
+	finder := procs.finder()
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		envRegex map[string]string
+		expected []int
+	}{
+		{name: "exact value", env: map[string]string{"SERVICE_NAME": "billing"}, expected: []int{100}},
+		{name: "every value", env: map[string]string{"SERVICE_NAME": "billing", "ENV": "staging"}, expected: []int{}},
+		{name: "empty value", env: map[string]string{"EMPTY": ""}, expected: []int{100}},
+		// Only the first = separates the name from the value
+		{name: "value with =", env: map[string]string{"OPTS": "a=b"}, expected: []int{101}},
+		{name: "regex", envRegex: map[string]string{"SERVICE_NAME": "^billing"}, expected: []int{100, 101}},
+		{name: "anchored regex", envRegex: map[string]string{"SERVICE_NAME": "^billing$"}, expected: []int{100}},
+		{name: "regex needs the variable", envRegex: map[string]string{"MISSING": ".*"}, expected: []int{}},
+		{
+			name:     "value and regex",
+			env:      map[string]string{"ENV": "staging"},
+			envRegex: map[string]string{"SERVICE_NAME": "worker"},
+			expected: []int{101},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attachment := config.Attachment{BinaryName: "python3", Env: test.env, EnvRegex: test.envRegex}
+			if pids := findPids(t, finder, attachment); !reflect.DeepEqual(pids, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, pids)
+			}
+		})
+	}
+	if _, err := finder.Find(config.Attachment{EnvRegex: map[string]string{"ENV": "("}}); err == nil {
+		t.Errorf("Expected an invalid env_regex to be rejected")
+	}
+}
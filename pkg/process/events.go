@@ -0,0 +1,72 @@
+package process
+
+import "sync"
+
+// EventType is the kind of change a process went through
+type EventType int
+
+const (
+	// Fork is sent when a new process is forked
+	Fork EventType = iota
+	// Exec is sent when a process replaces its image by executing a new binary
+	Exec
+	// Exit is sent when a process exits
+	Exit
+)
+
+// String returns a human readable name for the event type
+func (t EventType) String() string {
+	switch t {
+	case Fork:
+		return "fork"
+	case Exec:
+		return "exec"
+	case Exit:
+		return "exit"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change in the lifecycle of a process
+type Event struct {
+	Type EventType
+	PID  int
+}
+
+// EventSource reports process events as they happen.
+// The events channel is closed once the source is closed, or if it stops working.
+type EventSource interface {
+	Events() <-chan Event
+	Close() error
+}
+
+// FakeEventSource is an EventSource whose events are sent by hand, so that code
+// consuming events can be exercised without root or a real kernel event source
+type FakeEventSource struct {
+	events    chan Event
+	closeOnce sync.Once
+}
+
+// NewFakeEventSource returns a new FakeEventSource
+func NewFakeEventSource() *FakeEventSource {
+	return &FakeEventSource{
+		events: make(chan Event),
+	}
+}
+
+// Send delivers an event to the consumer, blocking until it is received
+func (f *FakeEventSource) Send(event Event) {
+	f.events <- event
+}
+
+// Events returns the channel events are delivered on
+func (f *FakeEventSource) Events() <-chan Event {
+	return f.events
+}
+
+// Close closes the events channel. It must not be called concurrently with Send.
+func (f *FakeEventSource) Close() error {
+	f.closeOnce.Do(func() { close(f.events) })
+	return nil
+}
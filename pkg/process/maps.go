@@ -0,0 +1,90 @@
+package process
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ResolveLibrary finds the library the process has mapped that goes by the given short name,
+// and returns a path to it that can be opened from our mount namespace. The name may be the
+// library's file name (libssl.so.3), or a prefix of it, with or without the lib prefix (libssl, ssl).
+func ResolveLibrary(pid int, name string) (string, error) {
+	finder, err := NewFinder()
+	if err != nil {
+		return "", err
+	}
+	return finder.ResolveLibrary(pid, name)
+}
+
+// ResolveLibrary finds the library the process has mapped that goes by the given short name,
+// through the finder's proc filesystem
+func (f Finder) ResolveLibrary(pid int, name string) (string, error) {
+	files, err := f.MappedFiles(pid)
+	if err != nil {
+		return "", err
+	}
+	paths := []string{}
+	for path := range files {
+		base := filepath.Base(path)
+		if base == name {
+			return filepath.Join(f.RootPath(pid), path), nil
+		}
+		if matchesLibraryName(base, name) {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("No library matching %s is mapped by pid %d", name, pid)
+	}
+	if len(paths) > 1 {
+		sort.Strings(paths)
+		return "", fmt.Errorf("Library name %s is ambiguous for pid %d, which maps %s", name, pid, strings.Join(paths, ", "))
+	}
+	return filepath.Join(f.RootPath(pid), paths[0]), nil
+}
+
+// MappedFiles returns the set of files the process has mapped into memory, such as its
+// executable and libraries, as seen from its own mount namespace
+func MappedFiles(pid int) (map[string]bool, error) {
+	finder, err := NewFinder()
+	if err != nil {
+		return nil, err
+	}
+	return finder.MappedFiles(pid)
+}
+
+// MappedFiles returns the set of files the process has mapped into memory, through the
+// finder's proc filesystem
+func (f Finder) MappedFiles(pid int) (map[string]bool, error) {
+	proc, err := f.procfs.Proc(pid)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get process %d: %w", pid, err)
+	}
+	maps, err := proc.ProcMaps()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read memory mappings of pid %d: %w", pid, err)
+	}
+	files := map[string]bool{}
+	for _, mapping := range maps {
+		path := strings.TrimSuffix(mapping.Pathname, " (deleted)")
+		// Anonymous mappings, and pseudo-paths such as [heap] and [vdso], aren't files
+		if filepath.IsAbs(path) {
+			files[path] = true
+		}
+	}
+	return files, nil
+}
+
+// matchesLibraryName returns whether the library file name goes by the short name,
+// e.g. libc.so.6 and libc-2.31.so go by libc.so, libc and c, but libc.something doesn't
+func matchesLibraryName(base, name string) bool {
+	name = strings.TrimSuffix(name, ".so")
+	for _, prefix := range []string{name, "lib" + name} {
+		if base == prefix+".so" || strings.HasPrefix(base, prefix+".so.") || strings.HasPrefix(base, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
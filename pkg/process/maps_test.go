@@ -0,0 +1,83 @@
+package process
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveLibrary(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "nginx", maps: []string{
+		"/usr/sbin/nginx",
+		"/usr/lib/x86_64-linux-gnu/libssl.so.3",
+		"/usr/lib/x86_64-linux-gnu/libcrypto.so.3",
+		"/usr/lib/x86_64-linux-gnu/libc-2.31.so",
+		"/usr/lib/x86_64-linux-gnu/libssl.something (deleted)",
+		"/opt/plugins/libpcre.so.1",
+		"/opt/plugins/libpcre2-8.so.0",
+	}})
+	finder := procs.finder()
+	root := filepath.Join(procs.root, "100", "root")
+
+	tests := []struct {
+		name     string
+		expected string
+		err      string
+	}{
+		{name: "libssl.so.3", expected: "/usr/lib/x86_64-linux-gnu/libssl.so.3"},
+		{name: "libssl", expected: "/usr/lib/x86_64-linux-gnu/libssl.so.3"},
+		{name: "ssl", expected: "/usr/lib/x86_64-linux-gnu/libssl.so.3"},
+		{name: "libc", expected: "/usr/lib/x86_64-linux-gnu/libc-2.31.so"},
+		// libssl.something isn't a version of libssl, so libssl isn't ambiguous
+		{name: "libssl.so", expected: "/usr/lib/x86_64-linux-gnu/libssl.so.3"},
+		{name: "libssl.some", err: "No library matching libssl.some"},
+		{name: "libz", err: "No library matching libz"},
+		{name: "pcre", expected: "/opt/plugins/libpcre.so.1"},
+		{name: "libpcre2", expected: "/opt/plugins/libpcre2-8.so.0"},
+		{name: "libpcre2-8", expected: "/opt/plugins/libpcre2-8.so.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := finder.ResolveLibrary(100, test.name)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected an error containing %q, got %s, %v", test.err, path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The library is opened through the process's root, from our mount namespace
+			if expected := root + test.expected; path != expected {
+				t.Errorf("Expected %s, got %s", expected, path)
+			}
+		})
+	}
+}
+
+func TestResolveLibraryAmbiguous(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "python3", maps: []string{"/usr/lib/libssl.so.1.1", "/opt/venv/lib/libssl.so.3"}})
+	_, err := procs.finder().ResolveLibrary(100, "libssl")
+	if err == nil || !strings.Contains(err.Error(), "/opt/venv/lib/libssl.so.3, /usr/lib/libssl.so.1.1") {
+		t.Errorf("Expected libssl to be ambiguous, got %v", err)
+	}
+}
+
+func TestMappedFiles(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "redis-server", maps: []string{"/usr/bin/redis-server", "/usr/lib/libc.so.6 (deleted)", "[vdso]"}})
+	files, err := procs.finder().MappedFiles(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]bool{"/usr/bin/redis-server": true, "/usr/lib/libc.so.6": true}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v, got %v", expected, files)
+	}
+	if _, err := procs.finder().MappedFiles(101); err == nil {
+		t.Errorf("Expected an error for a missing process")
+	}
+}
@@ -0,0 +1,200 @@
+package process
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// These constants are lifted from linux/connector.h and linux/cn_proc.h
+const (
+	cnIdxProc = 0x1
+	cnValProc = 0x1
+
+	procCnMcastListen = 1
+	procCnMcastIgnore = 2
+
+	procEventFork = 0x00000001
+	procEventExec = 0x00000002
+	procEventExit = 0x80000000
+
+	// sizes of struct nlmsghdr, struct cn_msg and the header of struct proc_event
+	nlmsgHeaderLen    = syscall.NLMSG_HDRLEN
+	cnMsgLen          = 20
+	procEventHeadLen  = 16
+	netlinkBufferSize = 4096
+)
+
+// cnMsg mirrors struct cn_msg
+type cnMsg struct {
+	Idx   uint32
+	Val   uint32
+	Seq   uint32
+	Ack   uint32
+	Len   uint16
+	Flags uint16
+}
+
+// NetlinkEventSource is an EventSource built on the kernel's netlink proc connector.
+// It needs CAP_NET_ADMIN, and a kernel built with CONFIG_PROC_EVENTS.
+type NetlinkEventSource struct {
+	fd        int
+	events    chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNetlinkEventSource subscribes to the proc connector and starts delivering its events
+func NewNetlinkEventSource() (*NetlinkEventSource, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_CONNECTOR)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open netlink connector socket: %w", err)
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to bind netlink connector socket: %w", err)
+	}
+	// Time out reads periodically so that the reader notices when the source is closed
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to set netlink connector socket timeout: %w", err)
+	}
+	if err := sendMcastOp(fd, procCnMcastListen); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to subscribe to proc connector events: %w", err)
+	}
+	source := &NetlinkEventSource{
+		fd:     fd,
+		events: make(chan Event, 1024),
+		done:   make(chan struct{}),
+	}
+	go source.read()
+	return source, nil
+}
+
+// Events returns the channel events are delivered on
+func (n *NetlinkEventSource) Events() <-chan Event {
+	return n.events
+}
+
+// Close unsubscribes from the proc connector and stops delivering events
+func (n *NetlinkEventSource) Close() error {
+	n.closeOnce.Do(func() { close(n.done) })
+	return nil
+}
+
+// read delivers events until the source is closed or the socket fails
+func (n *NetlinkEventSource) read() {
+	defer close(n.events)
+	defer syscall.Close(n.fd)
+	defer sendMcastOp(n.fd, procCnMcastIgnore)
+	buf := make([]byte, netlinkBufferSize)
+	for {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+		count, _, err := syscall.Recvfrom(n.fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			// The kernel dropped events because we couldn't keep up; there's nothing to do
+			// about the lost ones but carry on
+			continue
+		}
+		if err != nil {
+			return
+		}
+		messages, err := syscall.ParseNetlinkMessage(buf[:count])
+		if err != nil {
+			continue
+		}
+		for _, message := range messages {
+			event, ok := parseProcEvent(message.Data)
+			if !ok {
+				continue
+			}
+			select {
+			case n.events <- event:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
+
+// parseProcEvent turns the payload of a proc connector message into an Event.
+// Only events about processes are reported, events about individual threads are dropped.
+func parseProcEvent(data []byte) (Event, bool) {
+	if len(data) < cnMsgLen+procEventHeadLen {
+		return Event{}, false
+	}
+	order := hostByteOrder()
+	payload := data[cnMsgLen:]
+	what := order.Uint32(payload[0:4])
+	body := payload[procEventHeadLen:]
+	switch what {
+	case procEventFork:
+		// struct fork_proc_event { parent_pid, parent_tgid, child_pid, child_tgid }
+		if len(body) < 16 {
+			return Event{}, false
+		}
+		pid, tgid := order.Uint32(body[8:12]), order.Uint32(body[12:16])
+		return Event{Type: Fork, PID: int(tgid)}, pid == tgid
+	case procEventExec:
+		// struct exec_proc_event { process_pid, process_tgid }
+		if len(body) < 8 {
+			return Event{}, false
+		}
+		pid, tgid := order.Uint32(body[0:4]), order.Uint32(body[4:8])
+		return Event{Type: Exec, PID: int(tgid)}, pid == tgid
+	case procEventExit:
+		// struct exit_proc_event { process_pid, process_tgid, exit_code, exit_signal }
+		if len(body) < 8 {
+			return Event{}, false
+		}
+		pid, tgid := order.Uint32(body[0:4]), order.Uint32(body[4:8])
+		return Event{Type: Exit, PID: int(tgid)}, pid == tgid
+	default:
+		return Event{}, false
+	}
+}
+
+// sendMcastOp sends a proc connector multicast operation, either to listen or to ignore events
+func sendMcastOp(fd int, op uint32) error {
+	order := hostByteOrder()
+	payload := new(bytes.Buffer)
+	msg := cnMsg{Idx: cnIdxProc, Val: cnValProc, Len: 4}
+	if err := binary.Write(payload, order, msg); err != nil {
+		return err
+	}
+	if err := binary.Write(payload, order, op); err != nil {
+		return err
+	}
+	header := syscall.NlMsghdr{
+		Len:  uint32(nlmsgHeaderLen + payload.Len()),
+		Type: syscall.NLMSG_DONE,
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, order, header); err != nil {
+		return err
+	}
+	buf.Write(payload.Bytes())
+	return syscall.Sendto(fd, buf.Bytes(), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// hostByteOrder returns the byte order of the host, which netlink messages are encoded in
+func hostByteOrder() binary.ByteOrder {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
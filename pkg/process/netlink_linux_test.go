@@ -0,0 +1,84 @@
+package process
+
+import (
+	"testing"
+)
+
+// procEventMessage builds the payload of a proc connector message for the event, whose body
+// holds the given 32 bit fields
+func procEventMessage(what uint32, fields ...uint32) []byte {
+	order := hostByteOrder()
+	data := make([]byte, cnMsgLen+procEventHeadLen+4*len(fields))
+	order.PutUint32(data[cnMsgLen:], what)
+	for i, field := range fields {
+		order.PutUint32(data[cnMsgLen+procEventHeadLen+4*i:], field)
+	}
+	return data
+}
+
+func TestParseProcEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected Event
+		ok       bool
+	}{
+		{
+			name:     "process fork",
+			data:     procEventMessage(procEventFork, 1, 1, 100, 100),
+			expected: Event{Type: Fork, PID: 100},
+			ok:       true,
+		},
+		{
+			name: "thread created",
+			data: procEventMessage(procEventFork, 100, 100, 101, 100),
+		},
+		{
+			name:     "process exec",
+			data:     procEventMessage(procEventExec, 100, 100),
+			expected: Event{Type: Exec, PID: 100},
+			ok:       true,
+		},
+		{
+			name: "thread exec",
+			data: procEventMessage(procEventExec, 101, 100),
+		},
+		{
+			name:     "process exit",
+			data:     procEventMessage(procEventExit, 100, 100, 0, 17),
+			expected: Event{Type: Exit, PID: 100},
+			ok:       true,
+		},
+		{
+			name: "thread exit",
+			data: procEventMessage(procEventExit, 101, 100, 0, 17),
+		},
+		{
+			name: "unknown event",
+			data: procEventMessage(0x00000004, 100, 100),
+		},
+		{
+			name: "truncated header",
+			data: make([]byte, cnMsgLen+procEventHeadLen-1),
+		},
+		{
+			name: "truncated fork",
+			data: procEventMessage(procEventFork, 1, 1, 100),
+		},
+		{
+			name: "truncated exit",
+			data: procEventMessage(procEventExit, 100),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, ok := parseProcEvent(test.data)
+			if ok != test.ok {
+				t.Fatalf("Expected ok to be %t, got %t", test.ok, ok)
+			}
+			if ok && event != test.expected {
+				t.Errorf("Expected %+v, got %+v", test.expected, event)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import "fmt"
+
+// NetlinkEventSource is an EventSource built on the kernel's netlink proc connector,
+// which is only available on linux
+type NetlinkEventSource struct{}
+
+// NewNetlinkEventSource always fails outside of linux
+func NewNetlinkEventSource() (*NetlinkEventSource, error) {
+	return nil, fmt.Errorf("The netlink proc connector is only available on linux")
+}
+
+// Events returns a nil channel, since no events are ever delivered
+func (n *NetlinkEventSource) Events() <-chan Event {
+	return nil
+}
+
+// Close does nothing
+func (n *NetlinkEventSource) Close() error {
+	return nil
+}
@@ -0,0 +1,31 @@
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// StalePidFileError is returned when a pid file points at a process that isn't running
+type StalePidFileError struct {
+	Path string
+	PID  int
+}
+
+func (e *StalePidFileError) Error() string {
+	return fmt.Sprintf("Pid file %s points at pid %d, which is not running", e.Path, e.PID)
+}
+
+// readPidFile returns the pid held in a pid file
+func readPidFile(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read pid file %s: %w", path, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("Pid file %s does not hold a valid pid: %q", path, contents)
+	}
+	return pid, nil
+}
@@ -2,40 +2,176 @@ package process
 
 import (
 	"fmt"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
 	"github.com/prometheus/procfs"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// maxSymlinks is the most symlinks that will be followed when resolving a path,
+// mirroring the kernel's own limit
+const maxSymlinks = 40
+
 // Finder finds processes that match requested binary attachments
 type Finder struct {
-	procfs procfs.FS
+	procfs     procfs.FS
+	mountPoint string
 }
 
 // NewFinder returns a new Finder
 func NewFinder() (Finder, error) {
-	fs, err := procfs.NewDefaultFS()
+	return NewFinderAt(procfs.DefaultMountPoint)
+}
+
+// NewFinderAt returns a new Finder for the proc filesystem mounted at mountPoint
+func NewFinderAt(mountPoint string) (Finder, error) {
+	fs, err := procfs.NewFS(mountPoint)
 	if err != nil {
 		return Finder{}, fmt.Errorf("Unable to build procfs: %w", err)
 	}
 	return Finder{
-		procfs: fs,
+		procfs:     fs,
+		mountPoint: mountPoint,
 	}, nil
 }
 
-// FindByBinaryName finds processes that match a given binary name
-func (f Finder) FindByBinaryName(binaryName string) (procfs.Procs, error) {
-	procs, err := f.procfs.AllProcs()
+// Find finds processes that match a given attachment
+func (f Finder) Find(attachment config.Attachment) (procfs.Procs, error) {
+	selector, err := f.newSelector(attachment)
 	if err != nil {
-		return procfs.Procs{}, fmt.Errorf("Unable to list processes: %w", err)
+		return procfs.Procs{}, err
+	}
+	procs, err := selector.candidates()
+	if err != nil {
+		return procfs.Procs{}, err
 	}
 	result := procfs.Procs{}
 	for _, proc := range procs {
-		comm, err := proc.Comm()
+		matches, err := selector.matches(proc)
 		if err != nil {
-			return procfs.Procs{}, fmt.Errorf("Unable to get comm for process %d: %w", proc.PID, err)
+			// A single process whose details can't be read, because it exited during the scan
+			// or because we aren't allowed to, shouldn't stop us from finding the others
+			zap.S().Debugf("Skipping process %d: %s", proc.PID, err)
+			continue
 		}
-		if comm == binaryName {
+		if matches {
 			result = append(result, proc)
 		}
 	}
+	if selector.onlyRoot || selector.onlyLeaf {
+		return selector.filterTree(result), nil
+	}
 	return result, nil
 }
+
+// Matches returns whether a single process matches a given attachment.
+// Attachments that filter the process tree can only be matched by Find, since whether
+// a process is a root or a leaf depends on every other matching process.
+func (f Finder) Matches(proc procfs.Proc, attachment config.Attachment) (bool, error) {
+	if attachment.FiltersTree() {
+		return false, fmt.Errorf("Attachment %s filters the process tree, so it can't be matched against a single process", attachment)
+	}
+	selector, err := f.newSelector(attachment)
+	if err != nil {
+		return false, err
+	}
+	return selector.matches(proc)
+}
+
+// ExecutablePath returns the path to the executable the process is running,
+// as seen from the process's own mount namespace
+func ExecutablePath(proc procfs.Proc) (string, error) {
+	executable, err := proc.Executable()
+	if err != nil {
+		return "", fmt.Errorf("Unable to get executable path for pid %d: %w", proc.PID, err)
+	}
+	// The executable may have been replaced on disk since the process started
+	return strings.TrimSuffix(executable, " (deleted)"), nil
+}
+
+// RootPath returns the path through which the filesystem of the process's mount namespace
+// can be reached from ours
+func RootPath(pid int) string {
+	return Finder{mountPoint: procfs.DefaultMountPoint}.RootPath(pid)
+}
+
+// RootPath returns the path through which the filesystem of the process's mount namespace
+// can be reached from ours, through the finder's proc filesystem
+func (f Finder) RootPath(pid int) string {
+	return filepath.Join(f.mountPoint, strconv.Itoa(pid), "root")
+}
+
+// ResolveInRoot resolves every symlink in path the way the process with the given pid would,
+// by following them relative to its root instead of ours. The result is a path in the
+// process's mount namespace.
+func ResolveInRoot(pid int, path string) (string, error) {
+	return Finder{mountPoint: procfs.DefaultMountPoint}.ResolveInRoot(pid, path)
+}
+
+// ResolveInRoot resolves path the way the process with the given pid would, through the
+// finder's proc filesystem
+func (f Finder) ResolveInRoot(pid int, path string) (string, error) {
+	root := f.RootPath(pid)
+	resolved := "/"
+	remaining := strings.Split(path, "/")
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		candidate := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, candidate))
+		if err != nil {
+			return "", fmt.Errorf("Unable to resolve %s for pid %d: %w", path, pid, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = candidate
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("Unable to resolve %s for pid %d: too many symlinks", path, pid)
+		}
+		target, err := os.Readlink(filepath.Join(root, candidate))
+		if err != nil {
+			return "", fmt.Errorf("Unable to resolve %s for pid %d: %w", path, pid, err)
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return resolved, nil
+}
+
+// Proc returns the process with the given pid
+func (f Finder) Proc(pid int) (procfs.Proc, error) {
+	proc, err := f.procfs.Proc(pid)
+	if err != nil {
+		return procfs.Proc{}, fmt.Errorf("Unable to get process %d: %w", pid, err)
+	}
+	return proc, nil
+}
+
+// IsRunning returns whether the process with the given pid is still running, and
+// is the same process that was started at startTime (in clock ticks after boot)
+func (f Finder) IsRunning(pid int, startTime uint64) bool {
+	proc, err := f.procfs.Proc(pid)
+	if err != nil {
+		return false
+	}
+	stat, err := proc.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Starttime == startTime
+}
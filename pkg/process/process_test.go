@@ -0,0 +1,179 @@
+package process
+
+import (
+	"fmt"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeProc describes a process to write into a fake proc filesystem. Anything left unset
+// isn't written, so reading it fails the way it would for a process we can't inspect.
+type fakeProc struct {
+	pid  int
+	ppid int
+	comm string
+	// cmdline holds the process's arguments
+	cmdline []string
+	// exe is the executable the process runs, in its own mount namespace
+	exe string
+	// cgroup is the contents of /proc/PID/cgroup
+	cgroup string
+	// environ holds the variables the process was started with, as KEY=value
+	environ []string
+	// unreadableEnviron makes reading the environment fail
+	unreadableEnviron bool
+	uid               int
+	// maps are the files the process has mapped
+	maps []string
+}
+
+// fakeProcFS is a proc filesystem in a temporary directory
+type fakeProcFS struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeProcFS(t *testing.T) *fakeProcFS {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return &fakeProcFS{t: t, root: root}
+}
+
+// add writes the process
+func (f *fakeProcFS) add(p fakeProc) {
+	dir := filepath.Join(f.root, strconv.Itoa(p.pid))
+	if err := os.MkdirAll(filepath.Join(dir, "root"), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	f.write(p.pid, "stat", fmt.Sprintf("%d (%s) S %d 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 1 0 100 0 0\n", p.pid, p.comm, p.ppid))
+	f.write(p.pid, "comm", p.comm+"\n")
+	f.write(p.pid, "status", fmt.Sprintf("Name:\t%s\nUid:\t%d\t%d\t%d\t%d\n", p.comm, p.uid, p.uid, p.uid, p.uid))
+	if p.cmdline != nil {
+		f.write(p.pid, "cmdline", strings.Join(p.cmdline, "\x00")+"\x00")
+	}
+	if p.exe != "" {
+		if err := os.Symlink(p.exe, filepath.Join(dir, "exe")); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	if p.cgroup != "" {
+		f.write(p.pid, "cgroup", p.cgroup)
+	}
+	if p.unreadableEnviron {
+		// Reading a directory fails even as root, unlike a file without permissions
+		if err := os.Mkdir(filepath.Join(dir, "environ"), 0755); err != nil {
+			f.t.Fatal(err)
+		}
+	} else if p.environ != nil {
+		f.write(p.pid, "environ", strings.Join(p.environ, "\x00")+"\x00")
+	}
+	maps := ""
+	for i, path := range p.maps {
+		maps += fmt.Sprintf("%08x-%08x r-xp 00000000 08:01 %d %s\n", 0x400000+i*0x10000, 0x410000+i*0x10000, 100+i, path)
+	}
+	maps += "7ffd00000000-7ffd00021000 rw-p 00000000 00:00 0 [stack]\n"
+	f.write(p.pid, "maps", maps)
+}
+
+// write writes a file of the process's proc directory
+func (f *fakeProcFS) write(pid int, name, contents string) {
+	if err := ioutil.WriteFile(filepath.Join(f.root, strconv.Itoa(pid), name), []byte(contents), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// addFile creates an empty file in the filesystem of the process's mount namespace
+func (f *fakeProcFS) addFile(pid int, path string) {
+	full := filepath.Join(f.root, strconv.Itoa(pid), "root", path)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(full, nil, 0755); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// addSymlink creates a symlink in the filesystem of the process's mount namespace
+func (f *fakeProcFS) addSymlink(pid int, path, target string) {
+	full := filepath.Join(f.root, strconv.Itoa(pid), "root", path)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.Symlink(target, full); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeProcFS) finder() Finder {
+	finder, err := NewFinderAt(f.root)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return finder
+}
+
+// findPids returns the pids of the processes matching the attachment, in order
+func findPids(t *testing.T, finder Finder, attachment config.Attachment) []int {
+	procs, err := finder.Find(attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pids := []int{}
+	for _, proc := range procs {
+		pids = append(pids, proc.PID)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+func TestResolveInRoot(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "python3"})
+	procs.addFile(100, "/usr/bin/python3.9")
+	procs.addSymlink(100, "/usr/bin/python3", "python3.9")
+	procs.addSymlink(100, "/usr/local/bin/python", "/usr/bin/python3")
+	procs.addSymlink(100, "/bin", "usr/bin")
+	procs.addSymlink(100, "/usr/bin/loop", "loop")
+	finder := procs.finder()
+
+	tests := []struct {
+		path     string
+		expected string
+		err      bool
+	}{
+		{path: "/usr/bin/python3.9", expected: "/usr/bin/python3.9"},
+		{path: "/usr/bin/python3", expected: "/usr/bin/python3.9"},
+		// An absolute symlink is followed from the process's root, not ours
+		{path: "/usr/local/bin/python", expected: "/usr/bin/python3.9"},
+		{path: "/bin/python3", expected: "/usr/bin/python3.9"},
+		{path: "/usr/local/../bin/python3", expected: "/usr/bin/python3.9"},
+		{path: "/usr/bin/missing", err: true},
+		{path: "/usr/bin/loop", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			resolved, err := finder.ResolveInRoot(100, test.path)
+			if test.err {
+				if err == nil {
+					t.Errorf("Expected an error, got %s", resolved)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, resolved)
+			}
+		})
+	}
+}
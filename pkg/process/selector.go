@@ -0,0 +1,323 @@
+package process
+
+import (
+	"fmt"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/prometheus/procfs"
+	"go.uber.org/zap"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// selector is an attachment prepared for matching against processes
+type selector struct {
+	finder           Finder
+	binaryName       string
+	cmdlineRegex     *regexp.Regexp
+	executablePath   string
+	cgroup           string
+	parentBinaryName string
+	onlyRoot         bool
+	onlyLeaf         bool
+	pidFile          string
+	env              *envSelector
+	uid              *int
+	all              []selector
+	any              []selector
+	exclude          []selector
+}
+
+// newSelector prepares the attachment, and every attachment nested in it, for matching
+func (f Finder) newSelector(attachment config.Attachment) (selector, error) {
+	return f.newNestedSelector(attachment, false)
+}
+
+// newNestedSelector prepares an attachment for matching; nested is set for attachments
+// inside all, any or exclude, which only ever see one process at a time
+func (f Finder) newNestedSelector(attachment config.Attachment, nested bool) (selector, error) {
+	s := selector{
+		finder:           f,
+		binaryName:       attachment.BinaryName,
+		executablePath:   attachment.ExecutablePath,
+		cgroup:           attachment.Cgroup,
+		parentBinaryName: attachment.ParentBinaryName,
+		onlyRoot:         attachment.OnlyRoot,
+		onlyLeaf:         attachment.OnlyLeaf,
+		pidFile:          attachment.PidFile,
+		uid:              attachment.UID,
+	}
+	if attachment.CmdlineRegex != "" {
+		var err error
+		s.cmdlineRegex, err = regexp.Compile(attachment.CmdlineRegex)
+		if err != nil {
+			return selector{}, fmt.Errorf("Invalid cmdline_regex %q: %w", attachment.CmdlineRegex, err)
+		}
+	}
+	if s.executablePath != "" {
+		if _, err := filepath.Match(s.executablePath, ""); err != nil {
+			return selector{}, fmt.Errorf("Invalid executable_path %q: %w", s.executablePath, err)
+		}
+	}
+	if s.cgroup != "" && !strings.HasPrefix(s.cgroup, "/") && trimRuntimePrefix(s.cgroup) == "" {
+		// An empty container ID would be a prefix of every container's
+		return selector{}, fmt.Errorf("Invalid cgroup %q: no container ID", s.cgroup)
+	}
+	env, err := newEnvSelector(attachment.Env, attachment.EnvRegex)
+	if err != nil {
+		return selector{}, err
+	}
+	s.env = env
+	if attachment.Path != "" {
+		return selector{}, fmt.Errorf("path attaches to every process, so it can't be combined with other selectors")
+	}
+	if nested && (s.onlyRoot || s.onlyLeaf) {
+		return selector{}, fmt.Errorf("only_root and only_leaf can't be nested in all, any or exclude")
+	}
+	for _, nestedAttachment := range attachment.All {
+		nestedSelector, err := f.newNestedSelector(nestedAttachment, true)
+		if err != nil {
+			return selector{}, fmt.Errorf("Invalid selector in all: %w", err)
+		}
+		s.all = append(s.all, nestedSelector)
+	}
+	for _, nestedAttachment := range attachment.Any {
+		nestedSelector, err := f.newNestedSelector(nestedAttachment, true)
+		if err != nil {
+			return selector{}, fmt.Errorf("Invalid selector in any: %w", err)
+		}
+		s.any = append(s.any, nestedSelector)
+	}
+	for _, nestedAttachment := range attachment.Exclude {
+		nestedSelector, err := f.newNestedSelector(nestedAttachment, true)
+		if err != nil {
+			return selector{}, fmt.Errorf("Invalid selector in exclude: %w", err)
+		}
+		s.exclude = append(s.exclude, nestedSelector)
+	}
+	if !s.hasCriteria() {
+		return selector{}, fmt.Errorf("Attachment has no selectors")
+	}
+	return s, nil
+}
+
+// hasCriteria returns whether the selector narrows down processes on its own.
+// Excludes alone don't count, since they only remove processes from what the rest matches.
+func (s selector) hasCriteria() bool {
+	return s.binaryName != "" || s.cmdlineRegex != nil || s.executablePath != "" || s.cgroup != "" ||
+		s.parentBinaryName != "" || s.pidFile != "" || s.env != nil || s.uid != nil || len(s.all) > 0 || len(s.any) > 0
+}
+
+// candidates returns the processes that may match the selector: the one in its pid file
+// if it has one, or every process otherwise
+func (s selector) candidates() (procfs.Procs, error) {
+	if s.pidFile == "" {
+		procs, err := s.finder.procfs.AllProcs()
+		if err != nil {
+			return procfs.Procs{}, fmt.Errorf("Unable to list processes: %w", err)
+		}
+		return procs, nil
+	}
+	pid, err := readPidFile(s.pidFile)
+	if err != nil {
+		return procfs.Procs{}, err
+	}
+	proc, err := s.finder.procfs.Proc(pid)
+	if err != nil {
+		return procfs.Procs{}, &StalePidFileError{Path: s.pidFile, PID: pid}
+	}
+	return procfs.Procs{proc}, nil
+}
+
+// matches returns whether the process matches every selector that is set, at least one
+// of the selectors in any, and none of the selectors in exclude
+func (s selector) matches(proc procfs.Proc) (bool, error) {
+	if s.pidFile != "" {
+		pid, err := readPidFile(s.pidFile)
+		if err != nil {
+			return false, err
+		}
+		if pid != proc.PID {
+			return false, nil
+		}
+	}
+	if s.binaryName != "" {
+		comm, err := proc.Comm()
+		if err != nil {
+			return false, fmt.Errorf("Unable to get comm for process %d: %w", proc.PID, err)
+		}
+		if comm != s.binaryName {
+			return false, nil
+		}
+	}
+	if s.cmdlineRegex != nil {
+		cmdline, err := proc.CmdLine()
+		if err != nil {
+			return false, fmt.Errorf("Unable to get cmdline for process %d: %w", proc.PID, err)
+		}
+		if !s.cmdlineRegex.MatchString(strings.Join(cmdline, " ")) {
+			return false, nil
+		}
+	}
+	if s.executablePath != "" {
+		matches, err := s.matchesExecutablePath(proc)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	if s.cgroup != "" {
+		matches, err := s.finder.matchesCgroup(proc, s.cgroup)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	if s.parentBinaryName != "" {
+		matches, err := s.matchesParentBinaryName(proc)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	if s.env != nil {
+		matches, err := s.env.matches(proc)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	if s.uid != nil {
+		matches, err := matchesUID(proc, *s.uid)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	for _, nested := range s.all {
+		matches, err := nested.matches(proc)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	if len(s.any) > 0 {
+		matches, err := matchesAny(proc, s.any)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	if len(s.exclude) > 0 {
+		excluded, err := matchesAny(proc, s.exclude)
+		if err != nil || excluded {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchesAny returns whether the process matches at least one of the selectors
+func matchesAny(proc procfs.Proc, selectors []selector) (bool, error) {
+	for _, nested := range selectors {
+		matches, err := nested.matches(proc)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchesUID returns whether the process runs with the given effective uid
+func matchesUID(proc procfs.Proc, uid int) (bool, error) {
+	status, err := proc.NewStatus()
+	if err != nil {
+		return false, fmt.Errorf("Unable to get status for process %d: %w", proc.PID, err)
+	}
+	effectiveUID, err := strconv.Atoi(status.UIDs[1])
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse uid %q of process %d: %w", status.UIDs[1], proc.PID, err)
+	}
+	return effectiveUID == uid, nil
+}
+
+// matchesParentBinaryName returns whether the process's parent has the selector's parent binary name
+func (s selector) matchesParentBinaryName(proc procfs.Proc) (bool, error) {
+	ppid, err := parentPid(proc)
+	if err != nil {
+		return false, err
+	}
+	parent, err := s.finder.procfs.Proc(ppid)
+	if err != nil {
+		return false, fmt.Errorf("Unable to get parent %d of process %d: %w", ppid, proc.PID, err)
+	}
+	comm, err := parent.Comm()
+	if err != nil {
+		return false, fmt.Errorf("Unable to get comm for process %d: %w", parent.PID, err)
+	}
+	return comm == s.parentBinaryName, nil
+}
+
+// filterTree narrows down the processes matching the selector to the roots and/or leaves
+// of the process trees they form. Processes that exit in the meantime are dropped.
+func (s selector) filterTree(procs procfs.Procs) procfs.Procs {
+	parents := make(map[int]int, len(procs))
+	alive := procfs.Procs{}
+	for _, proc := range procs {
+		ppid, err := parentPid(proc)
+		if err != nil {
+			zap.S().Debugf("Skipping process %d: %s", proc.PID, err)
+			continue
+		}
+		parents[proc.PID] = ppid
+		alive = append(alive, proc)
+	}
+	hasMatchingChild := map[int]bool{}
+	for _, ppid := range parents {
+		hasMatchingChild[ppid] = true
+	}
+	result := procfs.Procs{}
+	for _, proc := range alive {
+		if _, parentMatches := parents[parents[proc.PID]]; s.onlyRoot && parentMatches {
+			continue
+		}
+		if s.onlyLeaf && hasMatchingChild[proc.PID] {
+			continue
+		}
+		result = append(result, proc)
+	}
+	return result
+}
+
+// parentPid returns the pid of the process's parent, from /proc/PID/stat
+func parentPid(proc procfs.Proc) (int, error) {
+	stat, err := proc.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get stat for process %d: %w", proc.PID, err)
+	}
+	return stat.PPID, nil
+}
+
+// matchesExecutablePath returns whether the process is running an executable matching the selector's glob
+func (s selector) matchesExecutablePath(proc procfs.Proc) (bool, error) {
+	pattern := s.executablePath
+	executable, err := ExecutablePath(proc)
+	if err != nil {
+		return false, err
+	}
+	if matches, _ := filepath.Match(pattern, executable); matches {
+		return true, nil
+	}
+	if hasGlobMeta(pattern) {
+		return false, nil
+	}
+	// The kernel reports the executable with every symlink resolved, so a literal path
+	// such as /usr/bin/python3 has to be resolved the same way before comparing.
+	resolved, err := s.finder.ResolveInRoot(proc.PID, pattern)
+	if err != nil {
+		return false, nil
+	}
+	return resolved == executable, nil
+}
+
+// hasGlobMeta returns whether the pattern contains any glob special characters
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
@@ -0,0 +1,299 @@
+package process
+
+import (
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestCmdlineRegex(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "python3", cmdline: []string{"/usr/bin/python3", "-m", "celery", "worker"}})
+	procs.add(fakeProc{pid: 101, comm: "python3", cmdline: []string{"/usr/bin/python3", "-m", "celery", "beat"}})
+	procs.add(fakeProc{pid: 102, comm: "python3", cmdline: []string{"/usr/bin/python3", "manage.py", "runserver"}})
+	// Kernel threads have no cmdline
+	procs.add(fakeProc{pid: 103, comm: "kworker/0:1", cmdline: []string{}})
+	finder := procs.finder()
+
+	tests := []struct {
+		regex    string
+		expected []int
+	}{
+		// Arguments are joined by spaces
+		{regex: "-m celery worker$", expected: []int{100}},
+		{regex: "celery", expected: []int{100, 101}},
+		{regex: `^/usr/bin/python3 \S+\.py`, expected: []int{102}},
+		{regex: "^$", expected: []int{103}},
+		{regex: "java", expected: []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.regex, func(t *testing.T) {
+			if pids := findPids(t, finder, config.Attachment{CmdlineRegex: test.regex}); !reflect.DeepEqual(pids, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, pids)
+			}
+		})
+	}
+	if _, err := finder.Find(config.Attachment{CmdlineRegex: "("}); err == nil {
+		t.Errorf("Expected an invalid cmdline_regex to be rejected")
+	}
+}
+
+func TestExecutablePath(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "python3", exe: "/usr/bin/python3.9"})
+	procs.add(fakeProc{pid: 101, comm: "python3", exe: "/opt/python/3.11/bin/python3.11"})
+	procs.add(fakeProc{pid: 102, comm: "python3", exe: "/usr/bin/python3.8 (deleted)"})
+	// Each process sees /usr/bin/python3 through its own root, where it points somewhere else
+	procs.addFile(100, "/usr/bin/python3.9")
+	procs.addSymlink(100, "/usr/bin/python3", "python3.9")
+	procs.addFile(101, "/opt/python/3.11/bin/python3.11")
+	procs.addSymlink(101, "/usr/bin/python3", "/opt/python/3.11/bin/python3.11")
+	finder := procs.finder()
+
+	tests := []struct {
+		pattern  string
+		expected []int
+	}{
+		{pattern: "/usr/bin/python3.9", expected: []int{100}},
+		{pattern: "/usr/bin/python3*", expected: []int{100, 102}},
+		{pattern: "/opt/python/*/bin/python*", expected: []int{101}},
+		// A literal path is resolved in the process's root before comparing
+		{pattern: "/usr/bin/python3", expected: []int{100, 101}},
+		// The executable was replaced on disk after the process started
+		{pattern: "/usr/bin/python3.8", expected: []int{102}},
+		{pattern: "/usr/bin/ruby", expected: []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			if pids := findPids(t, finder, config.Attachment{ExecutablePath: test.pattern}); !reflect.DeepEqual(pids, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, pids)
+			}
+		})
+	}
+	if _, err := finder.Find(config.Attachment{ExecutablePath: "[/usr/bin"}); err == nil {
+		t.Errorf("Expected an invalid executable_path to be rejected")
+	}
+}
+
+func TestProcessTree(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 1, ppid: 0, comm: "init"})
+	// A pre-forking server, whose first worker forked a helper of its own
+	procs.add(fakeProc{pid: 100, ppid: 1, comm: "gunicorn"})
+	procs.add(fakeProc{pid: 101, ppid: 100, comm: "gunicorn"})
+	procs.add(fakeProc{pid: 102, ppid: 100, comm: "gunicorn"})
+	procs.add(fakeProc{pid: 103, ppid: 101, comm: "gunicorn"})
+	// A server that doesn't fork, and one started from a shell
+	procs.add(fakeProc{pid: 200, ppid: 1, comm: "gunicorn"})
+	procs.add(fakeProc{pid: 300, ppid: 1, comm: "bash"})
+	procs.add(fakeProc{pid: 301, ppid: 300, comm: "gunicorn"})
+	finder := procs.finder()
+
+	tests := []struct {
+		name       string
+		attachment config.Attachment
+		expected   []int
+	}{
+		{
+			name:       "every process",
+			attachment: config.Attachment{BinaryName: "gunicorn"},
+			expected:   []int{100, 101, 102, 103, 200, 301},
+		},
+		{
+			name:       "only root",
+			attachment: config.Attachment{BinaryName: "gunicorn", OnlyRoot: true},
+			expected:   []int{100, 200, 301},
+		},
+		{
+			name:       "only leaf",
+			attachment: config.Attachment{BinaryName: "gunicorn", OnlyLeaf: true},
+			expected:   []int{102, 103, 200, 301},
+		},
+		{
+			name:       "only root and leaf",
+			attachment: config.Attachment{BinaryName: "gunicorn", OnlyRoot: true, OnlyLeaf: true},
+			expected:   []int{200, 301},
+		},
+		{
+			name:       "parent binary name",
+			attachment: config.Attachment{BinaryName: "gunicorn", ParentBinaryName: "gunicorn"},
+			expected:   []int{101, 102, 103},
+		},
+		{
+			name:       "parent binary name alone",
+			attachment: config.Attachment{ParentBinaryName: "bash"},
+			expected:   []int{301},
+		},
+		{
+			// The tree is formed by the processes that match everything else
+			name:       "only leaf of children",
+			attachment: config.Attachment{ParentBinaryName: "gunicorn", OnlyLeaf: true},
+			expected:   []int{102, 103},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if pids := findPids(t, finder, test.attachment); !reflect.DeepEqual(pids, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, pids)
+			}
+		})
+	}
+}
+
+func TestMatchesRejectsTreeFilters(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, ppid: 1, comm: "gunicorn"})
+	finder := procs.finder()
+	proc, err := finder.Proc(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := finder.Matches(proc, config.Attachment{BinaryName: "gunicorn", OnlyLeaf: true}); err == nil {
+		t.Errorf("Expected only_leaf to be rejected when matching a single process")
+	}
+	if matches, err := finder.Matches(proc, config.Attachment{BinaryName: "gunicorn"}); err != nil || !matches {
+		t.Errorf("Expected the process to match, got %t, %v", matches, err)
+	}
+}
+
+func TestComposedSelectors(t *testing.T) {
+	procs := newFakeProcFS(t)
+	procs.add(fakeProc{pid: 100, comm: "python3", uid: 1000, cmdline: []string{"python3", "-m", "celery", "worker"}})
+	procs.add(fakeProc{pid: 101, comm: "python3", uid: 1000, cmdline: []string{"python3", "-m", "celery", "beat"}})
+	procs.add(fakeProc{pid: 102, comm: "python3", uid: 0, cmdline: []string{"python3", "-m", "celery", "worker"}})
+	procs.add(fakeProc{pid: 103, comm: "ruby", uid: 1000, cmdline: []string{"ruby", "app.rb"}})
+	procs.add(fakeProc{pid: 104, comm: "node", uid: 1000, cmdline: []string{"node", "app.js"}})
+	finder := procs.finder()
+	uid := func(uid int) *int { return &uid }
+
+	tests := []struct {
+		name       string
+		attachment config.Attachment
+		expected   []int
+	}{
+		{
+			name: "every python3 of uid 1000 but celery beat",
+			attachment: config.Attachment{
+				BinaryName: "python3",
+				UID:        uid(1000),
+				Exclude:    []config.Attachment{{CmdlineRegex: "celery beat"}},
+			},
+			expected: []int{100},
+		},
+		{
+			name: "all",
+			attachment: config.Attachment{All: []config.Attachment{
+				{UID: uid(1000)},
+				{CmdlineRegex: "celery"},
+			}},
+			expected: []int{100, 101},
+		},
+		{
+			name: "any",
+			attachment: config.Attachment{Any: []config.Attachment{
+				{BinaryName: "ruby"},
+				{BinaryName: "node"},
+			}},
+			expected: []int{103, 104},
+		},
+		{
+			name: "any combined with the other selectors",
+			attachment: config.Attachment{
+				UID: uid(0),
+				Any: []config.Attachment{{BinaryName: "python3"}, {BinaryName: "ruby"}},
+			},
+			expected: []int{102},
+		},
+		{
+			name: "nested any in all",
+			attachment: config.Attachment{All: []config.Attachment{
+				{Any: []config.Attachment{{BinaryName: "python3"}, {BinaryName: "ruby"}}},
+				{UID: uid(1000)},
+			}},
+			expected: []int{100, 101, 103},
+		},
+		{
+			name: "exclude with any",
+			attachment: config.Attachment{
+				UID:     uid(1000),
+				Exclude: []config.Attachment{{BinaryName: "node"}, {CmdlineRegex: "beat"}},
+			},
+			expected: []int{100, 103},
+		},
+		{
+			name: "nested exclude",
+			attachment: config.Attachment{Any: []config.Attachment{
+				{BinaryName: "python3", Exclude: []config.Attachment{{UID: uid(0)}}},
+				{BinaryName: "node"},
+			}},
+			expected: []int{100, 101, 104},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if pids := findPids(t, finder, test.attachment); !reflect.DeepEqual(pids, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, pids)
+			}
+		})
+	}
+}
+
+func TestInvalidSelectors(t *testing.T) {
+	procs := newFakeProcFS(t)
+	finder := procs.finder()
+	tests := []struct {
+		name       string
+		attachment config.Attachment
+	}{
+		{name: "no selectors", attachment: config.Attachment{}},
+		// Excludes only remove processes from what the rest matches
+		{name: "only exclude", attachment: config.Attachment{Exclude: []config.Attachment{{BinaryName: "python3"}}}},
+		{name: "only tree filters", attachment: config.Attachment{OnlyRoot: true}},
+		{name: "empty nested selector", attachment: config.Attachment{Any: []config.Attachment{{BinaryName: "python3"}, {}}}},
+		{name: "only_root in all", attachment: config.Attachment{All: []config.Attachment{{BinaryName: "python3", OnlyRoot: true}}}},
+		{name: "only_leaf in any", attachment: config.Attachment{Any: []config.Attachment{{BinaryName: "python3", OnlyLeaf: true}}}},
+		{name: "only_leaf in exclude", attachment: config.Attachment{BinaryName: "python3", Exclude: []config.Attachment{{BinaryName: "celery", OnlyLeaf: true}}}},
+		{name: "path with other selectors", attachment: config.Attachment{Path: "/usr/bin/python3", BinaryName: "python3"}},
+		{name: "invalid nested selector", attachment: config.Attachment{All: []config.Attachment{{CmdlineRegex: "("}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := finder.Find(test.attachment); err == nil {
+				t.Errorf("Expected %s to be rejected", test.attachment)
+			}
+		})
+	}
+}
+
+func TestHasCriteria(t *testing.T) {
+	regex := regexp.MustCompile("python")
+	uid := 0
+	tests := []struct {
+		name     string
+		selector selector
+		expected bool
+	}{
+		{name: "empty", selector: selector{}},
+		{name: "tree filters", selector: selector{onlyRoot: true, onlyLeaf: true}},
+		{name: "exclude", selector: selector{exclude: []selector{{binaryName: "python3"}}}},
+		{name: "binary name", selector: selector{binaryName: "python3"}, expected: true},
+		{name: "cmdline", selector: selector{cmdlineRegex: regex}, expected: true},
+		{name: "executable path", selector: selector{executablePath: "/usr/bin/*"}, expected: true},
+		{name: "cgroup", selector: selector{cgroup: "/kubepods"}, expected: true},
+		{name: "parent binary name", selector: selector{parentBinaryName: "gunicorn"}, expected: true},
+		{name: "pid file", selector: selector{pidFile: "/run/redis.pid"}, expected: true},
+		{name: "env", selector: selector{env: &envSelector{}}, expected: true},
+		// uid 0 is still a criterion
+		{name: "uid", selector: selector{uid: &uid}, expected: true},
+		{name: "all", selector: selector{all: []selector{{binaryName: "python3"}}}, expected: true},
+		{name: "any", selector: selector{any: []selector{{binaryName: "python3"}}}, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if hasCriteria := test.selector.hasCriteria(); hasCriteria != test.expected {
+				t.Errorf("Expected %t, got %t", test.expected, hasCriteria)
+			}
+		})
+	}
+}
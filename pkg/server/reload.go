@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// reloader reloads the exporter's config from a file
+type reloader struct {
+	configPath string
+	exporter   *exporter.Exporter
+	// mu serializes reloads, however they are triggered
+	mu sync.Mutex
+}
+
+// newReloader returns a reloader for the exporter, reading the config from configPath
+func newReloader(configPath string, e *exporter.Exporter) *reloader {
+	return &reloader{
+		configPath: configPath,
+		exporter:   e,
+	}
+}
+
+// reload reads the config again and hands it over to the exporter
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	newConfig, err := config.Load(r.configPath)
+	if err != nil {
+		return err
+	}
+	// The metrics the exporter describes may change, so it has to be registered again
+	oldConfig := r.exporter.Config()
+	prometheus.Unregister(r.exporter)
+	reloadErr := r.exporter.Reload(newConfig)
+	if err := prometheus.Register(r.exporter); err != nil {
+		// Go back to the config that was registered fine, rather than leave the exporter unregistered
+		if restoreErr := r.exporter.Reload(oldConfig); restoreErr != nil {
+			zap.S().Errorf("Error restoring the previous config: %s", restoreErr)
+		}
+		if restoreErr := prometheus.Register(r.exporter); restoreErr != nil {
+			zap.S().Errorf("Error registering exporter with the previous config: %s", restoreErr)
+		}
+		return fmt.Errorf("Error registering exporter, kept the previous config: %w", err)
+	}
+	if reloadErr != nil {
+		return fmt.Errorf("Error reloading exporter: %w", reloadErr)
+	}
+	zap.S().Infof("Reloaded config from %s", r.configPath)
+	return nil
+}
+
+// handleReload reloads the config on POST requests
+func (r *reloader) handleReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		zap.S().Errorf("Error reloading config: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// reloadOnSighup reloads the config whenever the process receives a SIGHUP, until stop is closed
+func (r *reloader) reloadOnSighup(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-signals:
+			if err := r.reload(); err != nil {
+				zap.S().Errorf("Error reloading config: %s", err)
+			}
+		}
+	}
+}
+
+// reloadOnChange reloads the config whenever the contents of the file change, until stop is closed.
+// The file's directory is watched rather than the file itself, since kubernetes updates
+// ConfigMap volumes by swapping a symlink, which a watch on the file would miss.
+func (r *reloader) reloadOnChange(stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		zap.S().Errorf("Unable to watch %s for changes: %s", r.configPath, err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(r.configPath)); err != nil {
+		zap.S().Errorf("Unable to watch %s for changes: %s", r.configPath, err)
+		return
+	}
+	contents, err := ioutil.ReadFile(r.configPath)
+	if err != nil {
+		zap.S().Warnf("Unable to read %s: %s", r.configPath, err)
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			zap.S().Errorf("Error watching %s for changes: %s", r.configPath, err)
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			newContents, err := ioutil.ReadFile(r.configPath)
+			if err != nil || bytes.Equal(contents, newContents) {
+				continue
+			}
+			contents = newContents
+			zap.S().Infof("%s changed, reloading it", r.configPath)
+			if err := r.reload(); err != nil {
+				zap.S().Errorf("Error reloading config: %s", err)
+			}
+		}
+	}
+}
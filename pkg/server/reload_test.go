@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeConfig writes a config with a single program, attached to no process, exporting a
+// counter with the given name
+func writeConfig(t *testing.T, path string, counterName string) {
+	contents := fmt.Sprintf(`programs:
+  - name: test
+    metrics:
+      counters:
+        - name: %s
+          help: Calls
+          table: calls
+          labels:
+            - name: gen
+              size: 8
+              decoders:
+                - name: uint
+    attachment:
+      binary_name: "no-such-binary"
+    code: ""
+`, counterName)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadKeepsConfigWhenRegisteringFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, "calls_total")
+	oldConfig, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := exporter.New(oldConfig)
+	if err := prometheus.Register(e); err != nil {
+		t.Fatal(err)
+	}
+	defer prometheus.Unregister(e)
+
+	// The new counter clashes with a metric that's already registered with other labels
+	conflicting := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "userspace_exporter_conflict_total", Help: "Conflict"}, []string{"other"})
+	if err := prometheus.Register(conflicting); err != nil {
+		t.Fatal(err)
+	}
+	defer prometheus.Unregister(conflicting)
+	writeConfig(t, path, "conflict_total")
+
+	if err := newReloader(path, e).reload(); err == nil {
+		t.Fatal("Expected reloading to fail")
+	}
+	if !reflect.DeepEqual(e.Config(), oldConfig) {
+		t.Errorf("Expected the previous config to be restored, got %+v", e.Config())
+	}
+	if !prometheus.Unregister(e) {
+		t.Errorf("Expected the exporter to still be registered")
+	}
+}
@@ -3,14 +3,30 @@ package server
 import (
 	"github.com/josecv/ebpf-userspace-exporter/pkg/config"
 	"github.com/josecv/ebpf-userspace-exporter/pkg/exporter"
+	"github.com/josecv/ebpf-userspace-exporter/pkg/process"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"net/http"
+	"time"
 )
 
-// Serve starts the server
-func Serve(listenAddr, metricsPath string, config config.Config) {
+// Options describes how the server runs
+type Options struct {
+	ListenAddr  string
+	MetricsPath string
+	// DiscoveryInterval is how often to rescan for new processes to attach to
+	DiscoveryInterval time.Duration
+	// ProcessEvents also tracks processes as they start and exit through the proc connector
+	ProcessEvents bool
+	// ConfigPath is where the config is reloaded from
+	ConfigPath string
+	// WatchConfig reloads the config whenever the file at ConfigPath changes
+	WatchConfig bool
+}
+
+// Serve starts the server with the given initial config
+func Serve(options Options, config config.Config) {
 	logger, err := zap.NewProduction()
 	if err != nil {
 		panic(err)
@@ -26,12 +42,31 @@ func Serve(listenAddr, metricsPath string, config config.Config) {
 	if err != nil {
 		zap.S().Fatalf("Error attaching probes: %s", err)
 	}
+	stop := make(chan struct{})
+	defer close(stop)
+	var events <-chan process.Event
+	if options.ProcessEvents {
+		source, err := process.NewNetlinkEventSource()
+		if err != nil {
+			zap.S().Warnf("Process events are unavailable, falling back to rescanning processes every %s: %s", options.DiscoveryInterval, err)
+		} else {
+			defer source.Close()
+			events = source.Events()
+		}
+	}
+	go e.Discover(events, options.DiscoveryInterval, stop)
 	err = prometheus.Register(e)
 	if err != nil {
 		zap.S().Fatalf("Error registering exporter: %s", err)
 	}
-	http.Handle(metricsPath, promhttp.Handler())
-	zap.S().Infof("Serving metrics at %s%s", listenAddr, metricsPath)
-	err = http.ListenAndServe(listenAddr, nil)
+	r := newReloader(options.ConfigPath, e)
+	go r.reloadOnSighup(stop)
+	if options.WatchConfig {
+		go r.reloadOnChange(stop)
+	}
+	http.Handle(options.MetricsPath, promhttp.Handler())
+	http.HandleFunc("/-/reload", r.handleReload)
+	zap.S().Infof("Serving metrics at %s%s", options.ListenAddr, options.MetricsPath)
+	err = http.ListenAndServe(options.ListenAddr, nil)
 	zap.S().Fatal(err)
 }
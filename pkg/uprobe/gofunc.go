@@ -0,0 +1,150 @@
+package uprobe
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+	"golang.org/x/arch/arm64/arm64asm"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// GoReturnAddresses returns the virtual address of every return instruction in the Go function
+// in the ELF binary at path. Attaching uprobes at each of them emulates a uretprobe, which
+// can't be used on Go programs since the runtime moves goroutine stacks around, corrupting the
+// return addresses uretprobes replace. Functions are looked up in the binary's .gopclntab,
+// so binaries stripped of their symbol table and DWARF still work.
+func GoReturnAddresses(path, function string) ([]uint64, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %w", path, err)
+	}
+	defer file.Close()
+	table, err := goSymbolTable(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read Go symbol table of %s: %w", path, err)
+	}
+	fn := table.LookupFunc(function)
+	if fn == nil {
+		return nil, fmt.Errorf("Unable to find Go function %s in %s", function, path)
+	}
+	code, err := functionCode(file, fn.Entry, fn.End)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read code of %s in %s: %w", function, path, err)
+	}
+	offsets, err := returnOffsets(file.Machine, code)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to disassemble %s in %s: %w", function, path, err)
+	}
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("Go function %s in %s has no return instructions", function, path)
+	}
+	addresses := []uint64{}
+	for _, offset := range offsets {
+		addresses = append(addresses, fn.Entry+offset)
+	}
+	return addresses, nil
+}
+
+// goSymbolTable reads the Go symbol table of the binary from its .gopclntab
+func goSymbolTable(file *elf.File) (*gosym.Table, error) {
+	pclntab := file.Section(".gopclntab")
+	if pclntab == nil {
+		return nil, fmt.Errorf("No .gopclntab section, is this a Go binary?")
+	}
+	pclntabData, err := pclntab.Data()
+	if err != nil {
+		return nil, err
+	}
+	var textStart uint64
+	if text := file.Section(".text"); text != nil {
+		textStart = text.Addr
+	}
+	// Only binaries built before Go 1.3 have anything in .gosymtab, but gosym still accepts it
+	var symtabData []byte
+	if symtab := file.Section(".gosymtab"); symtab != nil {
+		if symtabData, err = symtab.Data(); err != nil {
+			return nil, err
+		}
+	}
+	return gosym.NewTable(symtabData, gosym.NewLineTable(pclntabData, textStart))
+}
+
+// functionCode returns the machine code between the start and end addresses
+func functionCode(file *elf.File, start, end uint64) ([]byte, error) {
+	for _, section := range file.Sections {
+		if section.Flags&elf.SHF_EXECINSTR == 0 || start < section.Addr || end > section.Addr+section.Size {
+			continue
+		}
+		code := make([]byte, end-start)
+		if _, err := section.ReadAt(code, int64(start-section.Addr)); err != nil {
+			return nil, err
+		}
+		return code, nil
+	}
+	return nil, fmt.Errorf("0x%x-0x%x is not in an executable section", start, end)
+}
+
+// decodableVEX holds the only VEX encoded instructions x86asm decodes. Any other is taken for
+// legacy prefixes followed by an unrelated, possibly longer, instruction, which could swallow
+// a return right after it, rather than failing.
+var decodableVEX = map[x86asm.Op]bool{
+	x86asm.VMOVDQA:    true,
+	x86asm.VMOVDQU:    true,
+	x86asm.VMOVNTDQ:   true,
+	x86asm.VMOVNTDQA:  true,
+	x86asm.VZEROUPPER: true,
+}
+
+// vexEncoded returns whether the instruction starts with a VEX prefix
+func vexEncoded(inst x86asm.Inst) bool {
+	for _, prefix := range inst.Prefix {
+		if prefix&0xff == 0xc4 || prefix&0xff == 0xc5 {
+			return true
+		}
+	}
+	return false
+}
+
+// returnOffsets returns the offset of every return instruction in the code. On amd64, where
+// instructions have different lengths, every instruction has to be decoded to find where the
+// next one starts, so code that can't be fully decoded is rejected rather than scanned for
+// return opcodes, which could be found in the middle of other instructions.
+func returnOffsets(machine elf.Machine, code []byte) ([]uint64, error) {
+	offsets := []uint64{}
+	switch machine {
+	case elf.EM_X86_64:
+		for offset := 0; offset < len(code); {
+			inst, err := x86asm.Decode(code[offset:], 64)
+			if err == nil && (inst.Op == 0 || vexEncoded(inst) && !decodableVEX[inst.Op]) {
+				err = x86asm.ErrUnrecognized
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to decode the instruction at offset 0x%x (% x): %w; "+
+					"VEX and EVEX encoded instructions (AVX, AVX-512, and the BMI instructions Go uses with GOAMD64=v3 and up) aren't supported",
+					offset, code[offset:minInt(offset+4, len(code))], err)
+			}
+			if inst.Op == x86asm.RET {
+				offsets = append(offsets, uint64(offset))
+			}
+			offset += inst.Len
+		}
+	case elf.EM_AARCH64:
+		// Instructions are all 4 bytes long, so there's no need to decode the ones that aren't returns
+		for offset := 0; offset+4 <= len(code); offset += 4 {
+			inst, err := arm64asm.Decode(code[offset : offset+4])
+			if err == nil && inst.Op == arm64asm.RET {
+				offsets = append(offsets, uint64(offset))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported architecture %s", machine)
+	}
+	return offsets, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
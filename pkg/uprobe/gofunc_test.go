@@ -0,0 +1,113 @@
+package uprobe
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildFixture builds the Go program in testdata/gofunc for the architecture, with any extra
+// environment variables, skipping the test if there's no Go toolchain
+func buildFixture(t *testing.T, goarch string, env ...string) string {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No go toolchain to build the fixture with")
+	}
+	dir, err := ioutil.TempDir("", "gofunc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	binary := filepath.Join(dir, "gofunc")
+	cmd := exec.Command(goTool, "build", "-o", binary, ".")
+	cmd.Dir = filepath.Join("testdata", "gofunc")
+	cmd.Env = append(os.Environ(), append([]string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=" + goarch, "GOFLAGS="}, env...)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Unable to build fixture: %s\n%s", err, output)
+	}
+	return binary
+}
+
+// codeAt returns size bytes of code at the virtual address in the binary
+func codeAt(t *testing.T, path string, address uint64, size int) []byte {
+	file, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	code, err := functionCode(file, address, address+uint64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestGoReturnAddresses(t *testing.T) {
+	arm64Ret := make([]byte, 4)
+	binary.LittleEndian.PutUint32(arm64Ret, 0xd65f03c0)
+	tests := []struct {
+		goarch string
+		ret    []byte
+	}{
+		{goarch: "amd64", ret: []byte{0xc3}},
+		{goarch: "arm64", ret: arm64Ret},
+	}
+	for _, test := range tests {
+		t.Run(test.goarch, func(t *testing.T) {
+			path := buildFixture(t, test.goarch)
+			addresses, err := GoReturnAddresses(path, "main.classify")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addresses) == 0 {
+				t.Fatal("Expected return addresses for main.classify")
+			}
+			for _, address := range addresses {
+				if code := codeAt(t, path, address, len(test.ret)); !bytes.Equal(code, test.ret) {
+					t.Errorf("Expected a return instruction at 0x%x, got % x", address, code)
+				}
+			}
+			if _, err := GoReturnAddresses(path, "main.missing"); err == nil {
+				t.Errorf("Expected an error for a function that doesn't exist")
+			}
+		})
+	}
+}
+
+func TestGoReturnAddressesRejectsVEX(t *testing.T) {
+	path := buildFixture(t, "amd64", "GOAMD64=v3")
+	_, err := GoReturnAddresses(path, "main.shift")
+	if err == nil {
+		t.Skip("The compiler didn't use a VEX encoded instruction for main.shift")
+	}
+	if !strings.Contains(err.Error(), "VEX") {
+		t.Errorf("Expected the error to name VEX encoded instructions, got %s", err)
+	}
+}
+
+func TestReturnOffsets(t *testing.T) {
+	// shlx rax, rax, rbx; ret; int3, where x86asm would take the shlx and the ret for a test
+	code := []byte{0xc4, 0xe2, 0xe1, 0xf7, 0xc0, 0xc3, 0xcc, 0xcc, 0xcc, 0xcc}
+	if _, err := returnOffsets(elf.EM_X86_64, code); err == nil {
+		t.Errorf("Expected VEX encoded instructions to be rejected")
+	}
+	// vzeroupper; ret, which x86asm does decode
+	offsets, err := returnOffsets(elf.EM_X86_64, []byte{0xc5, 0xf8, 0x77, 0xc3})
+	if err != nil || len(offsets) != 1 || offsets[0] != 3 {
+		t.Errorf("Expected a return at 3, got %v, %v", offsets, err)
+	}
+	offsets, err = returnOffsets(elf.EM_X86_64, []byte{0x90, 0xc3, 0x48, 0x89, 0xc3, 0xc3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 0xc3 in mov rbx, rax isn't a return
+	if len(offsets) != 2 || offsets[0] != 1 || offsets[1] != 5 {
+		t.Errorf("Expected returns at 1 and 5, got %v", offsets)
+	}
+}
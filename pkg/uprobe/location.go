@@ -0,0 +1,195 @@
+package uprobe
+
+import (
+	"debug/elf"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LocationKind is how a Location identifies the instruction a probe is attached to
+type LocationKind int
+
+const (
+	// SymbolLocation is an offset into a symbol, such as PyEval_EvalFrameDefault+0x1a
+	SymbolLocation LocationKind = iota
+	// AddressLocation is a virtual address, as laid out in the binary, such as 0x4f2a10
+	AddressLocation
+	// FileOffsetLocation is an offset from the start of the binary's file, such as +0xf2a10
+	FileOffsetLocation
+	// PatternLocation is every function whose symbol matches a glob (PyEval_*)
+	// or a regular expression between slashes (/^_ZN7MyClass/)
+	PatternLocation
+)
+
+// Location is where in a binary a probe is attached
+type Location struct {
+	Kind LocationKind
+	// Symbol is the symbol a SymbolLocation is relative to, or the pattern of a PatternLocation
+	Symbol string
+	// Offset is relative to the symbol, the address itself, or relative to the start of the file,
+	// depending on the kind of location
+	Offset uint64
+	// pattern matches the symbols of a PatternLocation
+	pattern *regexp.Regexp
+}
+
+// ParseLocation parses the location of a probe, given as a symbol, an offset into a symbol
+// (symbol+0x1a), a virtual address (0x4f2a10), an offset into the file (+0xf2a10), or a
+// pattern matching symbols (PyEval_* or /^PyEval_/)
+func ParseLocation(location string) (Location, error) {
+	if len(location) > 1 && strings.HasPrefix(location, "/") && strings.HasSuffix(location, "/") {
+		pattern, err := regexp.Compile(location[1 : len(location)-1])
+		if err != nil {
+			return Location{}, fmt.Errorf("Invalid symbol regex %s: %w", location, err)
+		}
+		return Location{Kind: PatternLocation, Symbol: location, pattern: pattern}, nil
+	}
+	if strings.HasPrefix(location, "+") {
+		offset, err := strconv.ParseUint(location[1:], 0, 64)
+		if err != nil {
+			return Location{}, fmt.Errorf("Invalid file offset %s: %w", location, err)
+		}
+		return Location{Kind: FileOffsetLocation, Offset: offset}, nil
+	}
+	if strings.HasPrefix(location, "0x") || strings.HasPrefix(location, "0X") {
+		address, err := strconv.ParseUint(location, 0, 64)
+		if err != nil {
+			return Location{}, fmt.Errorf("Invalid address %s: %w", location, err)
+		}
+		return Location{Kind: AddressLocation, Offset: address}, nil
+	}
+	symbol := location
+	var offset uint64
+	if i := strings.LastIndex(location, "+"); i != -1 {
+		var err error
+		offset, err = strconv.ParseUint(location[i+1:], 0, 64)
+		if err != nil {
+			return Location{}, fmt.Errorf("Invalid offset into symbol %s: %w", location, err)
+		}
+		symbol = location[:i]
+	}
+	if strings.ContainsAny(symbol, "*?[") {
+		if offset != 0 {
+			return Location{}, fmt.Errorf("Invalid location %s: offsets can't be given for a pattern", location)
+		}
+		if _, err := path.Match(symbol, ""); err != nil {
+			return Location{}, fmt.Errorf("Invalid symbol glob %s: %w", location, err)
+		}
+		return Location{Kind: PatternLocation, Symbol: symbol}, nil
+	}
+	return Location{Kind: SymbolLocation, Symbol: symbol, Offset: offset}, nil
+}
+
+// Matches returns whether the symbol matches the pattern of a PatternLocation
+func (l Location) Matches(symbol string) bool {
+	if l.pattern != nil {
+		return l.pattern.MatchString(symbol)
+	}
+	matches, _ := path.Match(l.Symbol, symbol)
+	return matches
+}
+
+// MatchingSymbols returns the functions in the ELF binary at path whose symbol matches the
+// pattern of a PatternLocation, sorted by name. Symbols that alias a function already
+// matched under another name are left out, so that no function is probed twice.
+func (l Location) MatchingSymbols(path string) ([]string, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %w", path, err)
+	}
+	defer file.Close()
+	symbols, _ := file.Symbols()
+	dynamicSymbols, _ := file.DynamicSymbols()
+	candidates := append(symbols, dynamicSymbols...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	matches := []string{}
+	addresses := map[uint64]bool{}
+	for _, symbol := range candidates {
+		if elf.ST_TYPE(symbol.Info) != elf.STT_FUNC || symbol.Value == 0 || addresses[symbol.Value] {
+			continue
+		}
+		if l.Matches(symbol.Name) {
+			addresses[symbol.Value] = true
+			matches = append(matches, symbol.Name)
+		}
+	}
+	return matches, nil
+}
+
+// IsSymbol returns whether the location is the start of a symbol, which bcc can resolve by itself
+func (l Location) IsSymbol() bool {
+	return l.Kind == SymbolLocation && l.Offset == 0
+}
+
+// String formats the location the way ParseLocation parses it
+func (l Location) String() string {
+	switch l.Kind {
+	case AddressLocation:
+		return fmt.Sprintf("0x%x", l.Offset)
+	case FileOffsetLocation:
+		return fmt.Sprintf("+0x%x", l.Offset)
+	case PatternLocation:
+		return l.Symbol
+	}
+	if l.Offset == 0 {
+		return l.Symbol
+	}
+	return fmt.Sprintf("%s+0x%x", l.Symbol, l.Offset)
+}
+
+// Address returns the virtual address of the location in the ELF binary at path, checking
+// that it lands on executable code, and inside the function for offsets into a symbol
+func (l Location) Address(path string) (uint64, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to open %s: %w", path, err)
+	}
+	defer file.Close()
+	switch l.Kind {
+	case PatternLocation:
+		return 0, fmt.Errorf("%s matches many symbols, rather than a single address", l)
+	case SymbolLocation:
+		return l.symbolAddress(file, path)
+	case FileOffsetLocation:
+		for _, prog := range file.Progs {
+			if isExecutableSegment(prog) && l.Offset >= prog.Off && l.Offset < prog.Off+prog.Filesz {
+				return l.Offset - prog.Off + prog.Vaddr, nil
+			}
+		}
+		return 0, fmt.Errorf("File offset 0x%x is not in an executable segment of %s", l.Offset, path)
+	}
+	for _, prog := range file.Progs {
+		if isExecutableSegment(prog) && l.Offset >= prog.Vaddr && l.Offset < prog.Vaddr+prog.Filesz {
+			return l.Offset, nil
+		}
+	}
+	return 0, fmt.Errorf("Address 0x%x is not in an executable segment of %s", l.Offset, path)
+}
+
+// symbolAddress returns the address of the offset into the symbol, looking it up in the
+// symbol table, and in the dynamic symbol table for stripped binaries
+func (l Location) symbolAddress(file *elf.File, path string) (uint64, error) {
+	symbols, _ := file.Symbols()
+	dynamicSymbols, _ := file.DynamicSymbols()
+	for _, symbol := range append(symbols, dynamicSymbols...) {
+		if symbol.Name != l.Symbol || symbol.Value == 0 {
+			continue
+		}
+		if symbol.Size != 0 && l.Offset >= symbol.Size {
+			return 0, fmt.Errorf("Offset 0x%x is outside of %s in %s, which is %d bytes long", l.Offset, l.Symbol, path, symbol.Size)
+		}
+		return symbol.Value + l.Offset, nil
+	}
+	return 0, fmt.Errorf("Unable to find symbol %s in %s", l.Symbol, path)
+}
+
+// isExecutableSegment returns whether the program header describes a loaded segment of code
+func isExecutableSegment(prog *elf.Prog) bool {
+	return prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0
+}
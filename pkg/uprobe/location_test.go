@@ -0,0 +1,221 @@
+package uprobe
+
+import (
+	"debug/elf"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		expected Location
+		err      string
+	}{
+		{location: "PyEval_EvalFrameDefault", expected: Location{Kind: SymbolLocation, Symbol: "PyEval_EvalFrameDefault"}},
+		{location: "PyEval_EvalFrameDefault+0x1a", expected: Location{Kind: SymbolLocation, Symbol: "PyEval_EvalFrameDefault", Offset: 0x1a}},
+		{location: "main.classify+12", expected: Location{Kind: SymbolLocation, Symbol: "main.classify", Offset: 12}},
+		// Only the last + separates the offset, C++ operators keep theirs
+		{location: "operator++0x4", expected: Location{Kind: SymbolLocation, Symbol: "operator+", Offset: 4}},
+		{location: "0x4f2a10", expected: Location{Kind: AddressLocation, Offset: 0x4f2a10}},
+		{location: "0X4F2A10", expected: Location{Kind: AddressLocation, Offset: 0x4f2a10}},
+		{location: "+0xf2a10", expected: Location{Kind: FileOffsetLocation, Offset: 0xf2a10}},
+		{location: "+4096", expected: Location{Kind: FileOffsetLocation, Offset: 4096}},
+		{location: "PyEval_*", expected: Location{Kind: PatternLocation, Symbol: "PyEval_*"}},
+		{location: "Py?val_[A-Z]*", expected: Location{Kind: PatternLocation, Symbol: "Py?val_[A-Z]*"}},
+		{location: "symbol+", err: "Invalid offset into symbol"},
+		{location: "symbol+0xzz", err: "Invalid offset into symbol"},
+		{location: "symbol+-1", err: "Invalid offset into symbol"},
+		{location: "0x", err: "Invalid address"},
+		{location: "0x4f2a10g", err: "Invalid address"},
+		{location: "+", err: "Invalid file offset"},
+		{location: "+0x10+0x10", err: "Invalid file offset"},
+		{location: "PyEval_*+0x4", err: "offsets can't be given for a pattern"},
+		{location: "PyEval_[", err: "Invalid symbol glob"},
+		{location: "/PyEval_(/", err: "Invalid symbol regex"},
+	}
+	for _, test := range tests {
+		t.Run(test.location, func(t *testing.T) {
+			location, err := ParseLocation(test.location)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected an error containing %q, got %+v, %v", test.err, location, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(location, test.expected) {
+				t.Errorf("Expected %+v, got %+v", test.expected, location)
+			}
+		})
+	}
+}
+
+func TestParseLocationRegex(t *testing.T) {
+	location, err := ParseLocation("/^_ZN7MyClass/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Kind != PatternLocation || location.IsSymbol() || location.String() != "/^_ZN7MyClass/" {
+		t.Errorf("Expected a pattern, got %+v", location)
+	}
+	for symbol, expected := range map[string]bool{"_ZN7MyClass3getEv": true, "_ZN7MyClass": true, "_ZN9OtherClass3getEv": false} {
+		if matches := location.Matches(symbol); matches != expected {
+			t.Errorf("Expected %s matching to be %t", symbol, expected)
+		}
+	}
+	// A single slash is a symbol, not an empty regex
+	if location, err := ParseLocation("/"); err != nil || location.Kind != SymbolLocation {
+		t.Errorf("Expected a symbol, got %+v, %v", location, err)
+	}
+}
+
+func TestLocationString(t *testing.T) {
+	for _, text := range []string{"classify", "classify+0x1a", "0x4f2a10", "+0xf2a10", "PyEval_*", "/^PyEval_/"} {
+		location, err := ParseLocation(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.String() != text {
+			t.Errorf("Expected %s to be formatted the way it was parsed, got %s", text, location)
+		}
+		if isSymbol := text == "classify"; location.IsSymbol() != isSymbol {
+			t.Errorf("Expected %s to be a symbol: %t", text, isSymbol)
+		}
+	}
+}
+
+// fixtureSymbols returns the symbols of the fixture by name
+func fixtureSymbols(t *testing.T, path string) map[string]elf.Symbol {
+	file, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	symbols, err := file.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]elf.Symbol{}
+	for _, symbol := range symbols {
+		byName[symbol.Name] = symbol
+	}
+	return byName
+}
+
+// fixtureText returns the executable segment of the fixture
+func fixtureText(t *testing.T, path string) elf.ProgHeader {
+	file, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, prog := range file.Progs {
+		if isExecutableSegment(prog) {
+			return prog.ProgHeader
+		}
+	}
+	t.Fatal("No executable segment in the fixture")
+	return elf.ProgHeader{}
+}
+
+func TestLocationAddress(t *testing.T) {
+	path := buildFixture(t, "amd64")
+	classify := fixtureSymbols(t, path)["main.classify"]
+	text := fixtureText(t, path)
+	// An address within the code, and the file offset it's loaded from
+	address := classify.Value + 4
+	offset := address - text.Vaddr + text.Off
+
+	tests := []struct {
+		location string
+		expected uint64
+		err      string
+	}{
+		{location: "main.classify", expected: classify.Value},
+		{location: fmt.Sprintf("main.classify+0x%x", classify.Size-1), expected: classify.Value + classify.Size - 1},
+		{location: fmt.Sprintf("main.classify+0x%x", classify.Size), err: "is outside of main.classify"},
+		{location: "main.missing+0x4", err: "Unable to find symbol main.missing"},
+		{location: fmt.Sprintf("0x%x", address), expected: address},
+		{location: fmt.Sprintf("0x%x", text.Vaddr+text.Filesz), err: "is not in an executable segment"},
+		{location: "0x10", err: "is not in an executable segment"},
+		{location: fmt.Sprintf("+0x%x", offset), expected: address},
+		{location: fmt.Sprintf("+0x%x", text.Off+text.Filesz), err: "is not in an executable segment"},
+		{location: "main.*", err: "matches many symbols"},
+	}
+	for _, test := range tests {
+		t.Run(test.location, func(t *testing.T) {
+			location, err := ParseLocation(test.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resolved, err := location.Address(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected an error containing %q, got 0x%x, %v", test.err, resolved, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved != test.expected {
+				t.Errorf("Expected 0x%x, got 0x%x", test.expected, resolved)
+			}
+		})
+	}
+	if _, err := (Location{Kind: SymbolLocation, Symbol: "main.classify"}).Address("testdata/missing"); err == nil {
+		t.Errorf("Expected an error for a missing binary")
+	}
+}
+
+func TestMatchingSymbols(t *testing.T) {
+	path := buildFixture(t, "amd64")
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{pattern: "main.[cs]*", expected: []string{"main.classify", "main.shift"}},
+		{pattern: "main.c?assify", expected: []string{"main.classify"}},
+		{pattern: `/^main\.(classify|shift)$/`, expected: []string{"main.classify", "main.shift"}},
+		{pattern: "/^main.main$/", expected: []string{"main.main"}},
+		{pattern: "nothing_*", expected: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			location, err := ParseLocation(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			symbols, err := location.MatchingSymbols(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(symbols, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, symbols)
+			}
+		})
+	}
+	// Patterns only match functions, not data
+	location, err := ParseLocation("runtime.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols, err := location.MatchingSymbols(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(symbols) < 100 {
+		t.Errorf("Expected the runtime to have plenty of functions, got %d", len(symbols))
+	}
+	byName := fixtureSymbols(t, path)
+	for _, symbol := range symbols {
+		if elf.ST_TYPE(byName[symbol].Info) != elf.STT_FUNC {
+			t.Errorf("Expected %s to be a function", symbol)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package uprobe
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <bcc/bcc_common.h>
+#include <bcc/bcc_syms.h>
+*/
+import "C"
+
+// Symbolizer finds the symbols that addresses in a process belong to, such as the
+// instruction pointer a uprobe attached to many symbols fired at
+type Symbolizer struct {
+	Pid    int
+	cache  unsafe.Pointer
+	closed bool
+}
+
+// NewSymbolizer returns a new Symbolizer for the process with the given pid
+func NewSymbolizer(pid int) (*Symbolizer, error) {
+	cache := C.bcc_symcache_new(C.int(pid), nil)
+	if cache == nil {
+		return nil, fmt.Errorf("Unable to load symbols for pid %d", pid)
+	}
+	return &Symbolizer{
+		Pid:   pid,
+		cache: cache,
+	}, nil
+}
+
+// Symbol returns the name of the symbol the address is in
+func (s *Symbolizer) Symbol(address uint64) (string, error) {
+	if s.closed {
+		return "", fmt.Errorf("Symbolizer is closed")
+	}
+	var symbol C.struct_bcc_symbol
+	if C.bcc_symcache_resolve_no_demangle(s.cache, C.uint64_t(address), &symbol) < 0 {
+		return "", fmt.Errorf("Unable to find symbol for address 0x%x in pid %d", address, s.Pid)
+	}
+	return C.GoString(symbol.name), nil
+}
+
+// Close closes a Symbolizer. After this it cannot be used.
+func (s *Symbolizer) Close() {
+	if s.closed {
+		return
+	}
+	C.bcc_free_symcache(s.cache, C.int(s.Pid))
+	s.closed = true
+}
@@ -0,0 +1,28 @@
+// Command gofunc is built by the tests of GoReturnAddresses, which look up its functions
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// classify returns from two places
+//
+//go:noinline
+func classify(n int) string {
+	if n < 0 {
+		return "negative"
+	}
+	return fmt.Sprint(n)
+}
+
+// shift uses a variable shift, which is a VEX encoded SHLX with GOAMD64=v3
+//
+//go:noinline
+func shift(n uint64, by uint) uint64 {
+	return n << (by & 63)
+}
+
+func main() {
+	fmt.Println(classify(len(os.Args)), shift(uint64(len(os.Args)), uint(len(os.Args))))
+}
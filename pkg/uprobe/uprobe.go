@@ -0,0 +1,122 @@
+package uprobe
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <stdlib.h>
+#include <bcc/bcc_common.h>
+#include <bcc/libbpf.h>
+#include <bcc/bcc_syms.h>
+*/
+import "C"
+
+// Type is whether a probe fires on entry to a function, or on return from it
+type Type int
+
+const (
+	// Entry probes fire when the function is entered
+	Entry Type = iota
+	// Return probes fire when the function returns
+	Return
+)
+
+var eventNameRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// Probe is a uprobe attached to a single process, or to every process if its pid is -1.
+// Unlike the uprobes attached through bcc.Module, each one can be detached on its own,
+// so a module can be attached to many processes and detached from them as they exit.
+type Probe struct {
+	eventName string
+	fd        int
+	closed    bool
+}
+
+// Attach attaches the loaded uprobe program fd to the symbol in the library or binary name,
+// for the given pid, or for every process if pid is -1
+func Attach(probeType Type, name, symbol string, fd, pid int) (*Probe, error) {
+	path, offset, err := resolve(name, symbol, 0, pid)
+	if err != nil {
+		return nil, err
+	}
+	return attach(probeType, path, offset, fd, pid)
+}
+
+// AttachAddress attaches the loaded uprobe program fd to the virtual address in the library
+// or binary name, for the given pid, or for every process if pid is -1
+func AttachAddress(probeType Type, name string, address uint64, fd, pid int) (*Probe, error) {
+	path, offset, err := resolve(name, "", address, pid)
+	if err != nil {
+		return nil, err
+	}
+	return attach(probeType, path, offset, fd, pid)
+}
+
+// Close detaches the probe. After this it cannot be used.
+func (p *Probe) Close() {
+	if p.closed {
+		return
+	}
+	C.bpf_close_perf_event_fd(C.int(p.fd))
+	eventNameCS := C.CString(p.eventName)
+	defer C.free(unsafe.Pointer(eventNameCS))
+	C.bpf_detach_uprobe(eventNameCS)
+	p.closed = true
+}
+
+// resolve returns the file and offset at which symbol, or the virtual address if there's
+// no symbol, can be found in the library or binary name
+func resolve(name, symbol string, address uint64, pid int) (string, uint64, error) {
+	if pid == -1 {
+		pid = 0
+	}
+	nameCS := C.CString(name)
+	defer C.free(unsafe.Pointer(nameCS))
+	symbolCS := C.CString(symbol)
+	defer C.free(unsafe.Pointer(symbolCS))
+	var resolved C.struct_bcc_symbol
+	res := C.bcc_resolve_symname(nameCS, symbolCS, C.uint64_t(address), C.int(pid), nil, &resolved)
+	if res < 0 {
+		if symbol == "" {
+			return "", 0, fmt.Errorf("Unable to locate address 0x%x in %s", address, name)
+		}
+		return "", 0, fmt.Errorf("Unable to locate symbol %s in %s", symbol, name)
+	}
+	defer C.free(unsafe.Pointer(resolved.module))
+	return C.GoString(resolved.module), uint64(resolved.offset), nil
+}
+
+// attach attaches the loaded uprobe program fd at the offset into the file at path
+func attach(probeType Type, path string, offset uint64, fd, pid int) (*Probe, error) {
+	attachType := C.enum_bpf_probe_attach_type(C.BPF_PROBE_ENTRY)
+	prefix := "p"
+	if probeType == Return {
+		attachType = C.BPF_PROBE_RETURN
+		prefix = "r"
+	}
+	// The event name has to be unique, or attaching the same symbol in different processes
+	// would clash on kernels that don't support creating uprobes through perf_event_open
+	target := "all"
+	if pid != -1 {
+		target = strconv.Itoa(pid)
+	}
+	eventName := fmt.Sprintf("%s_%s_0x%x_%s", prefix, eventNameRegexp.ReplaceAllString(path, "_"), offset, target)
+	eventNameCS := C.CString(eventName)
+	defer C.free(unsafe.Pointer(eventNameCS))
+	pathCS := C.CString(path)
+	defer C.free(unsafe.Pointer(pathCS))
+	res, err := C.bpf_attach_uprobe(C.int(fd), attachType, eventNameCS, pathCS, C.uint64_t(offset), C.pid_t(pid), 0)
+	if res < 0 {
+		return nil, fmt.Errorf("Unable to attach uprobe to %s at 0x%x: %v", path, offset, err)
+	}
+	return &Probe{
+		eventName: eventName,
+		fd:        int(res),
+	}, nil
+}
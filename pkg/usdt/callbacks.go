@@ -0,0 +1,48 @@
+package usdt
+
+import (
+	"sync"
+)
+
+// handle identifies the state of an enumeration through bcc's callbacks, which is passed
+// through the C gateways so that concurrent enumerations don't share any state
+type handle uintptr
+
+// callbacks holds the state of every enumeration in progress
+var callbacks = struct {
+	sync.Mutex
+	next   handle
+	states map[handle]interface{}
+}{states: map[handle]interface{}{}}
+
+// registerCallbacks stores the state that the callbacks of an enumeration add to, and returns
+// the handle they find it by. It must be unregistered once the enumeration is done.
+func registerCallbacks(state interface{}) handle {
+	callbacks.Lock()
+	defer callbacks.Unlock()
+	callbacks.next++
+	callbacks.states[callbacks.next] = state
+	return callbacks.next
+}
+
+// lookupCallbacks returns the state of the enumeration with the handle
+func lookupCallbacks(h handle) interface{} {
+	callbacks.Lock()
+	defer callbacks.Unlock()
+	return callbacks.states[h]
+}
+
+// unregisterCallbacks forgets the state of the enumeration with the handle
+func unregisterCallbacks(h handle) {
+	callbacks.Lock()
+	defer callbacks.Unlock()
+	delete(callbacks.states, h)
+}
+
+// enumerate registers the state, and has the driver run the enumeration with its handle, which
+// the driver must pass on to every callback it makes
+func enumerate(state interface{}, driver func(h handle)) {
+	h := registerCallbacks(state)
+	defer unregisterCallbacks(h)
+	driver(h)
+}
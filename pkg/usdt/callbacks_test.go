@@ -0,0 +1,82 @@
+package usdt
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// The drivers here stand in for bcc, making the callbacks' Go half directly rather than
+// through the C gateways, which can't be called from tests.
+
+func TestConcurrentEnumerations(t *testing.T) {
+	const enumerations = 64
+	const callbacksEach = 16
+	var wg sync.WaitGroup
+	for i := 0; i < enumerations; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			fnName := fmt.Sprintf("fn_%d", i)
+			uprobes := collectUprobes(func(h handle) {
+				for j := 0; j < callbacksEach; j++ {
+					if err := addUprobe(h, uprobeCbArg{fnName: fnName, pid: j}); err != nil {
+						t.Error(err)
+						return
+					}
+					// Interleave with the other enumerations as much as possible
+					runtime.Gosched()
+				}
+			})
+			if len(uprobes) != callbacksEach {
+				t.Errorf("Expected %d uprobes for %s, got %d", callbacksEach, fnName, len(uprobes))
+			}
+			for j, uprobe := range uprobes {
+				if uprobe.fnName != fnName || uprobe.pid != j {
+					t.Errorf("Expected uprobe %d of %s, got %+v", j, fnName, uprobe)
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("probe_%d", i)
+			probes := []probeCbArg{}
+			enumerate(&probes, func(h handle) {
+				for j := 0; j < callbacksEach; j++ {
+					if err := addProbe(h, probeCbArg{name: name, numLocations: j}); err != nil {
+						t.Error(err)
+						return
+					}
+					runtime.Gosched()
+				}
+			})
+			if len(probes) != callbacksEach {
+				t.Errorf("Expected %d probes for %s, got %d", callbacksEach, name, len(probes))
+			}
+			for j, probe := range probes {
+				if probe.name != name || probe.numLocations != j {
+					t.Errorf("Expected probe %d of %s, got %+v", j, name, probe)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestUnknownHandles(t *testing.T) {
+	var finished handle
+	collectUprobes(func(h handle) {
+		finished = h
+		// A uprobe enumeration's handle doesn't lead to somewhere probes can be added
+		if err := addProbe(h, probeCbArg{}); err == nil {
+			t.Errorf("Expected adding a probe to a uprobe enumeration to fail")
+		}
+	})
+	if err := addUprobe(finished, uprobeCbArg{}); err == nil {
+		t.Errorf("Expected adding a uprobe to a finished enumeration to fail")
+	}
+	if err := addUprobe(handle(0), uprobeCbArg{}); err == nil {
+		t.Errorf("Expected adding a uprobe to an enumeration that never existed to fail")
+	}
+}
@@ -2,10 +2,33 @@ package usdt
 
 /*
 #include <stdint.h>
+#include <bcc/bcc_usdt.h>
+
+// bcc's callbacks don't take any user data, so the handle of the enumeration in progress is
+// kept per thread for the gateways to pass on. Each enumeration runs within a single call
+// from Go, so it never changes threads halfway through.
+static __thread uintptr_t current_handle;
 
 void uprobe_cb_gateway (const char *path, const char *fn_name, uint64_t addr, int pid) {
-	void uprobeCb(const char *path, const char *fn_name, uint64_t addr, int pid);
-	uprobeCb(path, fn_name, addr, pid);
+	void uprobeCb(uintptr_t handle, const char *path, const char *fn_name, uint64_t addr, int pid);
+	uprobeCb(current_handle, path, fn_name, addr, pid);
+}
+
+void probe_cb_gateway (struct bcc_usdt *probe) {
+	void probeCb(uintptr_t handle, struct bcc_usdt *probe);
+	probeCb(current_handle, probe);
+}
+
+void foreach_uprobe (void *usdt, uintptr_t handle) {
+	current_handle = handle;
+	bcc_usdt_foreach_uprobe(usdt, uprobe_cb_gateway);
+	current_handle = 0;
+}
+
+void foreach_probe (void *usdt, uintptr_t handle) {
+	current_handle = handle;
+	bcc_usdt_foreach(usdt, probe_cb_gateway);
+	current_handle = 0;
 }
 */
 import "C"
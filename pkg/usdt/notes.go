@@ -0,0 +1,351 @@
+package usdt
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Note is a USDT probe as declared by an ELF note in the .note.stapsdt section of a binary or library
+type Note struct {
+	Provider string
+	Name     string
+	// PC is the address the probe fires from, adjusted for any prelinking of the file
+	PC uint64
+	// Base is the address of the .stapsdt.base section when the note was written
+	Base uint64
+	// Semaphore is the address of the probe's semaphore, adjusted like PC, or 0 if it has none
+	Semaphore uint64
+	Arguments []Argument
+}
+
+// String returns the note's fully specified probe name, as accepted by EnableProbe
+func (n Note) String() string {
+	return n.Provider + ":" + n.Name
+}
+
+// Matches returns whether the note declares the probe, given either as provider:name or as a bare name
+func (n Note) Matches(probe string) bool {
+	if parts := strings.SplitN(probe, ":", 2); len(parts) == 2 {
+		return parts[0] == n.Provider && parts[1] == n.Name
+	}
+	return probe == n.Name
+}
+
+// ArgumentKind describes where a probe argument is read from
+type ArgumentKind int
+
+const (
+	// ConstantArgument is a value known when the probe was compiled
+	ConstantArgument ArgumentKind = iota
+	// RegisterArgument is the value of a register
+	RegisterArgument
+	// MemoryArgument is read from memory, at an address computed from registers, an offset and a symbol
+	MemoryArgument
+)
+
+// Argument is a probe argument parsed from its specification, e.g. -4@%eax or 8@-16(%rbp)
+type Argument struct {
+	Spec string
+	Kind ArgumentKind
+	// Size is how many bytes the argument takes, or 0 if the specification doesn't say
+	Size   int
+	Signed bool
+	// Constant is the value of a ConstantArgument
+	Constant int64
+	// Register is the register of a RegisterArgument, or the base register of a MemoryArgument
+	Register string
+	// Index and Scale are the index register of a MemoryArgument, and what it's multiplied by
+	Index string
+	Scale int
+	// Offset and Symbol are added to the address of a MemoryArgument
+	Offset int64
+	Symbol string
+}
+
+// String returns the argument's specification
+func (a Argument) String() string {
+	return a.Spec
+}
+
+// stapsdtNoteType is the type of the ELF notes that declare USDT probes
+const stapsdtNoteType = 3
+
+// ReadNotes returns the USDT probes declared by the binary or library at path, without running
+// or attaching to anything. Files without any USDT probes return no notes.
+func ReadNotes(path string) ([]Note, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %w", path, err)
+	}
+	defer file.Close()
+	section := file.Section(".note.stapsdt")
+	if section == nil {
+		return []Note{}, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read .note.stapsdt of %s: %w", path, err)
+	}
+	var base uint64
+	hasBase := false
+	if baseSection := file.Section(".stapsdt.base"); baseSection != nil {
+		base, hasBase = baseSection.Addr, true
+	}
+	notes, err := parseNotes(data, file.ByteOrder, file.Class, file.Machine)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid .note.stapsdt in %s: %w", path, err)
+	}
+	if hasBase {
+		// A prelinked file is moved as a whole, so the difference between the base it was
+		// written with and where it is now applies to every address
+		for i := range notes {
+			notes[i].PC += base - notes[i].Base
+			if notes[i].Semaphore != 0 {
+				notes[i].Semaphore += base - notes[i].Base
+			}
+		}
+	}
+	return notes, nil
+}
+
+// parseNotes parses the contents of a .note.stapsdt section
+func parseNotes(data []byte, order binary.ByteOrder, class elf.Class, machine elf.Machine) ([]Note, error) {
+	addrSize := 8
+	if class == elf.ELFCLASS32 {
+		addrSize = 4
+	}
+	notes := []Note{}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, fmt.Errorf("Truncated note header")
+		}
+		nameSize, descSize, noteType := order.Uint32(data), order.Uint32(data[4:]), order.Uint32(data[8:])
+		nameEnd := 12 + align4(uint64(nameSize))
+		descEnd := nameEnd + align4(uint64(descSize))
+		if uint64(len(data)) < descEnd {
+			return nil, fmt.Errorf("Truncated note")
+		}
+		name := string(bytes.TrimRight(data[12:12+nameSize], "\x00"))
+		desc := data[nameEnd : nameEnd+uint64(descSize)]
+		data = data[descEnd:]
+		if name != "stapsdt" || noteType != stapsdtNoteType {
+			continue
+		}
+		note, err := parseNote(desc, order, addrSize, machine)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	return notes, nil
+}
+
+// parseNote parses the description of a single note: the pc, base and semaphore addresses,
+// followed by the provider, the name and the argument specifications as strings
+func parseNote(desc []byte, order binary.ByteOrder, addrSize int, machine elf.Machine) (Note, error) {
+	if len(desc) < 3*addrSize {
+		return Note{}, fmt.Errorf("Truncated note description")
+	}
+	addresses := make([]uint64, 3)
+	for i := range addresses {
+		if addrSize == 4 {
+			addresses[i] = uint64(order.Uint32(desc[i*addrSize:]))
+		} else {
+			addresses[i] = order.Uint64(desc[i*addrSize:])
+		}
+	}
+	strs := strings.SplitN(string(desc[3*addrSize:]), "\x00", 4)
+	if len(strs) < 3 {
+		return Note{}, fmt.Errorf("Note description is missing its provider, name or arguments")
+	}
+	note := Note{
+		Provider:  strs[0],
+		Name:      strs[1],
+		PC:        addresses[0],
+		Base:      addresses[1],
+		Semaphore: addresses[2],
+		Arguments: []Argument{},
+	}
+	for _, spec := range splitArguments(strs[2]) {
+		argument, err := ParseArgument(spec, machine)
+		if err != nil {
+			return Note{}, fmt.Errorf("Invalid argument of probe %s: %w", note, err)
+		}
+		note.Arguments = append(note.Arguments, argument)
+	}
+	return note, nil
+}
+
+// splitArguments splits a note's argument specifications, which are separated by spaces.
+// arm64 memory operands have a space of their own, e.g. 8@[sp, 16], so spaces within brackets
+// don't separate arguments.
+func splitArguments(args string) []string {
+	specs := []string{}
+	depth := 0
+	start := -1
+	for i, c := range args {
+		switch {
+		case c == ' ' && depth == 0:
+			if start >= 0 {
+				specs = append(specs, args[start:i])
+				start = -1
+			}
+			continue
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		specs = append(specs, args[start:])
+	}
+	return specs
+}
+
+// align4 rounds n up to a multiple of 4, which note names and descriptions are padded to
+func align4(n uint64) uint64 {
+	return (n + 3) &^ 3
+}
+
+// ParseArgument parses a probe argument specification: an optional size in bytes, negative
+// for signed arguments, then @ and an operand in the assembler syntax of the machine, e.g.
+// -4@%eax, 8@-16(%rbp) and 4@$5 on x86, or -4@x0, 8@[sp, 16] and 4@5 on arm64
+func ParseArgument(spec string, machine elf.Machine) (Argument, error) {
+	argument := Argument{Spec: spec}
+	operand := spec
+	if at := strings.Index(spec, "@"); at >= 0 {
+		size, err := strconv.Atoi(spec[:at])
+		if err != nil {
+			return Argument{}, fmt.Errorf("Invalid size in argument %q: %w", spec, err)
+		}
+		argument.Signed = size < 0
+		if size < 0 {
+			size = -size
+		}
+		argument.Size = size
+		operand = spec[at+1:]
+	}
+	var err error
+	if machine == elf.EM_AARCH64 {
+		err = parseARM64Operand(operand, &argument)
+	} else {
+		err = parseX86Operand(operand, &argument)
+	}
+	if err != nil {
+		return Argument{}, fmt.Errorf("Invalid argument %q: %w", spec, err)
+	}
+	return argument, nil
+}
+
+// parseX86Operand parses an operand in AT&T syntax: $constant, %register, or
+// [symbol][+-offset](%base[,%index[,scale]]) for memory
+func parseX86Operand(operand string, argument *Argument) error {
+	if strings.HasPrefix(operand, "$") {
+		constant, err := strconv.ParseInt(operand[1:], 0, 64)
+		if err != nil {
+			return err
+		}
+		argument.Kind, argument.Constant = ConstantArgument, constant
+		return nil
+	}
+	if strings.HasPrefix(operand, "%") {
+		argument.Kind, argument.Register = RegisterArgument, operand[1:]
+		return nil
+	}
+	argument.Kind = MemoryArgument
+	displacement := operand
+	if open := strings.Index(operand, "("); open >= 0 {
+		if !strings.HasSuffix(operand, ")") {
+			return fmt.Errorf("Unterminated memory operand")
+		}
+		displacement = operand[:open]
+		registers := strings.Split(operand[open+1:len(operand)-1], ",")
+		for i, register := range registers {
+			registers[i] = strings.TrimSpace(register)
+		}
+		if registers[0] != "" {
+			if !strings.HasPrefix(registers[0], "%") {
+				return fmt.Errorf("Invalid base register %q", registers[0])
+			}
+			argument.Register = registers[0][1:]
+		}
+		if len(registers) > 1 {
+			if !strings.HasPrefix(registers[1], "%") {
+				return fmt.Errorf("Invalid index register %q", registers[1])
+			}
+			argument.Index, argument.Scale = registers[1][1:], 1
+		}
+		if len(registers) > 2 {
+			scale, err := strconv.Atoi(registers[2])
+			if err != nil {
+				return fmt.Errorf("Invalid scale %q", registers[2])
+			}
+			argument.Scale = scale
+		}
+		if len(registers) > 3 {
+			return fmt.Errorf("Too many registers in memory operand")
+		}
+	}
+	return parseDisplacement(displacement, argument)
+}
+
+// parseDisplacement parses the symbol and/or offset added to a memory operand's address
+func parseDisplacement(displacement string, argument *Argument) error {
+	if displacement == "" {
+		return nil
+	}
+	if offset, err := strconv.ParseInt(displacement, 0, 64); err == nil {
+		argument.Offset = offset
+		return nil
+	}
+	symbol := displacement
+	if sign := strings.LastIndexAny(displacement, "+-"); sign > 0 {
+		offset, err := strconv.ParseInt(displacement[sign:], 0, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid offset %q", displacement[sign:])
+		}
+		symbol, argument.Offset = displacement[:sign], offset
+	}
+	argument.Symbol = symbol
+	return nil
+}
+
+// parseARM64Operand parses an operand in arm64 syntax: a constant, a register, or
+// [base[, offset]] for memory
+func parseARM64Operand(operand string, argument *Argument) error {
+	if strings.HasPrefix(operand, "[") {
+		if !strings.HasSuffix(operand, "]") {
+			return fmt.Errorf("Unterminated memory operand")
+		}
+		parts := strings.Split(operand[1:len(operand)-1], ",")
+		argument.Kind, argument.Register = MemoryArgument, strings.TrimSpace(parts[0])
+		if len(parts) > 2 {
+			return fmt.Errorf("Too many parts in memory operand")
+		}
+		if len(parts) == 2 {
+			offset, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(parts[1]), "#"), 0, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid offset %q", parts[1])
+			}
+			argument.Offset = offset
+		}
+		return nil
+	}
+	if constant, err := strconv.ParseInt(strings.TrimPrefix(operand, "#"), 0, 64); err == nil {
+		argument.Kind, argument.Constant = ConstantArgument, constant
+		return nil
+	}
+	if operand == "" {
+		return fmt.Errorf("Missing operand")
+	}
+	argument.Kind, argument.Register = RegisterArgument, operand
+	return nil
+}
@@ -0,0 +1,210 @@
+package usdt
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// symbolAddress returns the address of the symbol in the binary at path
+func symbolAddress(t *testing.T, path, name string) uint64 {
+	file, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	symbols, err := file.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range symbols {
+		if symbol.Name == name {
+			return symbol.Value
+		}
+	}
+	t.Fatalf("No symbol %s in %s", name, path)
+	return 0
+}
+
+func TestReadNotes(t *testing.T) {
+	start := symbolAddress(t, "testdata/probes-x86_64", "_start")
+	semaphore := symbolAddress(t, "testdata/probes-x86_64", "test_start_semaphore")
+	base := uint64(0x402000)
+	x86Start := Note{
+		Provider:  "test",
+		Name:      "start",
+		PC:        start,
+		Base:      base,
+		Semaphore: semaphore,
+		Arguments: []Argument{
+			{Spec: "-4@%eax", Kind: RegisterArgument, Size: 4, Signed: true, Register: "eax"},
+			{Spec: "8@-16(%rbp)", Kind: MemoryArgument, Size: 8, Register: "rbp", Offset: -16},
+			{Spec: "4@$5", Kind: ConstantArgument, Size: 4, Constant: 5},
+			{Spec: "8@counter+8(%rip)", Kind: MemoryArgument, Size: 8, Register: "rip", Offset: 8, Symbol: "counter"},
+			{Spec: "4@(%rdx,%rcx,4)", Kind: MemoryArgument, Size: 4, Register: "rdx", Index: "rcx", Scale: 4},
+		},
+	}
+	// The nop of each probe is a byte long
+	x86Stop := Note{Provider: "test", Name: "stop", PC: start + 1, Base: base, Arguments: []Argument{}}
+	// Prelinking moved .stapsdt.base, and everything else along with it, 0x1000 bytes further
+	prelinkedStart, prelinkedStop := x86Start, x86Stop
+	prelinkedStart.PC += 0x1000
+	prelinkedStart.Semaphore += 0x1000
+	prelinkedStop.PC += 0x1000
+	arm64Start := Note{
+		Provider: "test",
+		Name:     "start",
+		PC:       symbolAddress(t, "testdata/probes-arm64", "_start"),
+		Base:     base,
+		Arguments: []Argument{
+			{Spec: "-4@x0", Kind: RegisterArgument, Size: 4, Signed: true, Register: "x0"},
+			{Spec: "8@[sp, 16]", Kind: MemoryArgument, Size: 8, Register: "sp", Offset: 16},
+			{Spec: "4@5", Kind: ConstantArgument, Size: 4, Constant: 5},
+			{Spec: "8@[x1]", Kind: MemoryArgument, Size: 8, Register: "x1"},
+		},
+	}
+	tests := []struct {
+		path     string
+		expected []Note
+	}{
+		{path: "testdata/probes-x86_64", expected: []Note{x86Start, x86Stop}},
+		{path: "testdata/probes-x86_64-prelinked", expected: []Note{prelinkedStart, prelinkedStop}},
+		{path: "testdata/probes-arm64", expected: []Note{arm64Start}},
+		// The test binary itself has no probes
+		{path: os.Args[0], expected: []Note{}},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			notes, err := ReadNotes(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(notes, test.expected) {
+				t.Errorf("Expected notes %+v, got %+v", test.expected, notes)
+			}
+		})
+	}
+	if _, err := ReadNotes("testdata/probes-x86_64.S"); err == nil {
+		t.Errorf("Expected an error reading a file that isn't ELF")
+	}
+}
+
+func TestParseArgument(t *testing.T) {
+	tests := []struct {
+		spec     string
+		machine  elf.Machine
+		expected Argument
+	}{
+		{spec: "-4@%eax", machine: elf.EM_X86_64, expected: Argument{Kind: RegisterArgument, Size: 4, Signed: true, Register: "eax"}},
+		{spec: "8@-16(%rbp)", machine: elf.EM_X86_64, expected: Argument{Kind: MemoryArgument, Size: 8, Register: "rbp", Offset: -16}},
+		{spec: "1@$-1", machine: elf.EM_X86_64, expected: Argument{Kind: ConstantArgument, Size: 1, Constant: -1}},
+		{spec: "8@(%rax)", machine: elf.EM_X86_64, expected: Argument{Kind: MemoryArgument, Size: 8, Register: "rax"}},
+		{spec: "8@0x10(,%rcx,8)", machine: elf.EM_X86_64, expected: Argument{Kind: MemoryArgument, Size: 8, Index: "rcx", Scale: 8, Offset: 16}},
+		{spec: "4@counter-4(%rip)", machine: elf.EM_X86_64, expected: Argument{Kind: MemoryArgument, Size: 4, Register: "rip", Offset: -4, Symbol: "counter"}},
+		{spec: "%rdi", machine: elf.EM_X86_64, expected: Argument{Kind: RegisterArgument, Register: "rdi"}},
+		{spec: "-4@x0", machine: elf.EM_AARCH64, expected: Argument{Kind: RegisterArgument, Size: 4, Signed: true, Register: "x0"}},
+		{spec: "8@[sp, 16]", machine: elf.EM_AARCH64, expected: Argument{Kind: MemoryArgument, Size: 8, Register: "sp", Offset: 16}},
+		{spec: "8@[x29, #-8]", machine: elf.EM_AARCH64, expected: Argument{Kind: MemoryArgument, Size: 8, Register: "x29", Offset: -8}},
+		{spec: "8@[x1]", machine: elf.EM_AARCH64, expected: Argument{Kind: MemoryArgument, Size: 8, Register: "x1"}},
+		{spec: "4@#5", machine: elf.EM_AARCH64, expected: Argument{Kind: ConstantArgument, Size: 4, Constant: 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			argument, err := ParseArgument(test.spec, test.machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.expected.Spec = test.spec
+			if argument != test.expected {
+				t.Errorf("Expected %+v, got %+v", test.expected, argument)
+			}
+		})
+	}
+}
+
+func TestParseArgumentErrors(t *testing.T) {
+	tests := []struct {
+		spec    string
+		machine elf.Machine
+	}{
+		{spec: "x@%eax", machine: elf.EM_X86_64},
+		{spec: "4@$five", machine: elf.EM_X86_64},
+		{spec: "8@-16(%rbp", machine: elf.EM_X86_64},
+		{spec: "8@-16(rbp)", machine: elf.EM_X86_64},
+		{spec: "8@(%rax,rcx)", machine: elf.EM_X86_64},
+		{spec: "8@(%rax,%rcx,x)", machine: elf.EM_X86_64},
+		{spec: "8@(%rax,%rcx,4,2)", machine: elf.EM_X86_64},
+		{spec: "8@counter+x(%rip)", machine: elf.EM_X86_64},
+		{spec: "8@[sp, 16", machine: elf.EM_AARCH64},
+		{spec: "8@[sp, x]", machine: elf.EM_AARCH64},
+		{spec: "8@[sp, 16, 2]", machine: elf.EM_AARCH64},
+		{spec: "8@", machine: elf.EM_AARCH64},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			if argument, err := ParseArgument(test.spec, test.machine); err == nil {
+				t.Errorf("Expected an error, got %+v", argument)
+			}
+		})
+	}
+}
+
+// noteBytes returns a note as laid out in a .note.stapsdt section
+func noteBytes(name string, noteType uint32, desc []byte) []byte {
+	data := make([]byte, 12)
+	binary.LittleEndian.PutUint32(data, uint32(len(name)+1))
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(desc)))
+	binary.LittleEndian.PutUint32(data[8:], noteType)
+	data = append(data, name...)
+	data = append(data, make([]byte, align4(uint64(len(name)+1))-uint64(len(name)))...)
+	data = append(data, desc...)
+	return append(data, make([]byte, align4(uint64(len(desc)))-uint64(len(desc)))...)
+}
+
+// noteDesc returns the description of a note with 64 bit addresses
+func noteDesc(pc uint64, strs string) []byte {
+	desc := make([]byte, 24)
+	binary.LittleEndian.PutUint64(desc, pc)
+	return append(desc, strs...)
+}
+
+func TestParseNotes(t *testing.T) {
+	valid := noteBytes("stapsdt", stapsdtNoteType, noteDesc(0x1000, "test\x00start\x00-4@%eax\x00"))
+	notes, err := parseNotes(append(noteBytes("GNU", 1, []byte{1, 2, 3}), valid...), binary.LittleEndian, elf.ELFCLASS64, elf.EM_X86_64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].String() != "test:start" || notes[0].PC != 0x1000 || len(notes[0].Arguments) != 1 {
+		t.Errorf("Expected only test:start, other notes skipped, got %+v", notes)
+	}
+
+	desc32 := make([]byte, 12)
+	binary.LittleEndian.PutUint32(desc32, 0x1000)
+	notes, err = parseNotes(noteBytes("stapsdt", stapsdtNoteType, append(desc32, "test\x00start\x00\x00"...)), binary.LittleEndian, elf.ELFCLASS32, elf.EM_386)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].PC != 0x1000 || len(notes[0].Arguments) != 0 {
+		t.Errorf("Expected test:start with 32 bit addresses, got %+v", notes)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "truncated header", data: valid[:8]},
+		{name: "truncated note", data: valid[:len(valid)-4]},
+		{name: "truncated description", data: noteBytes("stapsdt", stapsdtNoteType, make([]byte, 16))},
+		{name: "missing arguments", data: noteBytes("stapsdt", stapsdtNoteType, noteDesc(0x1000, "test\x00start"))},
+		{name: "invalid argument", data: noteBytes("stapsdt", stapsdtNoteType, noteDesc(0x1000, "test\x00start\x00x@%eax\x00"))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if notes, err := parseNotes(test.data, binary.LittleEndian, elf.ELFCLASS64, elf.EM_X86_64); err == nil {
+				t.Errorf("Expected an error, got %+v", notes)
+			}
+		})
+	}
+}
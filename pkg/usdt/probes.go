@@ -0,0 +1,217 @@
+package usdt
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"unsafe"
+)
+
+/*
+#include <stdlib.h>
+#include <bcc/bcc_usdt.h>
+
+void foreach_probe (void *usdt, uintptr_t handle);
+*/
+import "C"
+
+// Probe describes a USDT probe built into a binary or library
+type Probe struct {
+	Provider string `json:"provider"`
+	Name     string `json:"name"`
+	// BinaryPath is the binary or library the probe is built into
+	BinaryPath string `json:"binary_path"`
+	// Semaphore is the address of the probe's semaphore, or 0 if it has none
+	Semaphore uint64     `json:"semaphore"`
+	Locations []Location `json:"locations"`
+}
+
+// Location is one of the places a probe fires from, each of which may read its arguments differently
+type Location struct {
+	Address    uint64 `json:"address"`
+	BinaryPath string `json:"binary_path"`
+	// Arguments are the specifications of the probe's arguments at this location,
+	// in the assembler syntax they are declared with, e.g. -4@%ax or 8@-16(%bp)
+	Arguments []string `json:"arguments"`
+}
+
+// String returns the probe's fully specified name, as accepted by EnableProbe
+func (p Probe) String() string {
+	return p.Provider + ":" + p.Name
+}
+
+// probeCbArg is a probe as reported by bcc, before its locations are looked up
+type probeCbArg struct {
+	provider     string
+	name         string
+	binaryPath   string
+	semaphore    uint64
+	numLocations int
+	numArguments int
+}
+
+//export probeCb
+func probeCb(h C.uintptr_t, probe *C.struct_bcc_usdt) {
+	// Panicking would unwind through bcc, so all that can be done with an error is to log it
+	err := addProbe(handle(h), probeCbArg{
+		provider:     C.GoString(probe.provider),
+		name:         C.GoString(probe.name),
+		binaryPath:   C.GoString(probe.bin_path),
+		semaphore:    uint64(probe.semaphore),
+		numLocations: int(probe.num_locations),
+		numArguments: int(probe.num_arguments),
+	})
+	if err != nil {
+		zap.S().Errorf("%s", err)
+	}
+}
+
+// addProbe adds a probe to the probes of the enumeration with the handle
+func addProbe(h handle, probe probeCbArg) error {
+	probes, ok := lookupCallbacks(h).(*[]probeCbArg)
+	if !ok {
+		return fmt.Errorf("No probe enumeration has handle %d", h)
+	}
+	*probes = append(*probes, probe)
+	return nil
+}
+
+// Probes returns every USDT probe in the context's process or binary, whether enabled or not
+func (c *Context) Probes() ([]Probe, error) {
+	if c.closed {
+		return nil, fmt.Errorf("Context is closed")
+	}
+	found := c.foreachProbe()
+	result := make([]Probe, 0, len(found))
+	for _, arg := range found {
+		probe := Probe{
+			Provider:   arg.provider,
+			Name:       arg.name,
+			BinaryPath: arg.binaryPath,
+			Semaphore:  arg.semaphore,
+		}
+		for i := 0; i < arg.numLocations; i++ {
+			location, err := c.location(arg, i)
+			if err != nil {
+				return nil, err
+			}
+			probe.Locations = append(probe.Locations, location)
+		}
+		result = append(result, probe)
+	}
+	return result, nil
+}
+
+// foreachProbe returns the probes bcc reports for the context
+func (c *Context) foreachProbe() []probeCbArg {
+	probes := []probeCbArg{}
+	enumerate(&probes, func(h handle) {
+		C.foreach_probe(c.context, C.uintptr_t(h))
+	})
+	return probes
+}
+
+// location looks up the address and arguments of the probe at the given location
+func (c *Context) location(probe probeCbArg, index int) (Location, error) {
+	providerCS := C.CString(probe.provider)
+	defer C.free(unsafe.Pointer(providerCS))
+	nameCS := C.CString(probe.name)
+	defer C.free(unsafe.Pointer(nameCS))
+	var location C.struct_bcc_usdt_location
+	if C.bcc_usdt_get_location(c.context, providerCS, nameCS, C.int(index), &location) != 0 {
+		return Location{}, fmt.Errorf("Unable to get location %d of USDT probe %s:%s", index, probe.provider, probe.name)
+	}
+	result := Location{
+		Address:    uint64(location.address),
+		BinaryPath: C.GoString(location.bin_path),
+		Arguments:  []string{},
+	}
+	for i := 0; i < probe.numArguments; i++ {
+		var argument C.struct_bcc_usdt_argument
+		if C.bcc_usdt_get_argument(c.context, providerCS, nameCS, C.int(index), C.int(i), &argument) != 0 {
+			return Location{}, fmt.Errorf("Unable to get argument %d at location %d of USDT probe %s:%s", i+1, index, probe.provider, probe.name)
+		}
+		result.Arguments = append(result.Arguments, argumentSpec(&argument))
+	}
+	return result, nil
+}
+
+// Flags of argument.valid, telling which of an argument's fields bcc set
+const (
+	argumentConstant      = C.BCC_USDT_ARGUMENT_CONSTANT
+	argumentDerefOffset   = C.BCC_USDT_ARGUMENT_DEREF_OFFSET
+	argumentDerefIdent    = C.BCC_USDT_ARGUMENT_DEREF_IDENT
+	argumentBaseRegister  = C.BCC_USDT_ARGUMENT_BASE_REGISTER_NAME
+	argumentIndexRegister = C.BCC_USDT_ARGUMENT_INDEX_REGISTER_NAME
+	argumentScale         = C.BCC_USDT_ARGUMENT_SCALE
+)
+
+// argument is an argument of a probe at one of its locations, as parsed by bcc. Only the
+// fields flagged in valid are set.
+type argument struct {
+	size          int
+	valid         int
+	constant      int64
+	derefOffset   int
+	derefIdent    string
+	baseRegister  string
+	indexRegister string
+	scale         int
+}
+
+// argumentSpec formats the argument bcc parsed in the assembler syntax of its declaration
+func argumentSpec(arg *C.struct_bcc_usdt_argument) string {
+	valid := int(arg.valid)
+	result := argument{
+		size:        int(arg.size),
+		valid:       valid,
+		constant:    int64(arg.constant),
+		derefOffset: int(arg.deref_offset),
+		scale:       int(arg.scale),
+	}
+	if valid&argumentDerefIdent != 0 {
+		result.derefIdent = C.GoString(arg.deref_ident)
+	}
+	if valid&argumentBaseRegister != 0 {
+		result.baseRegister = C.GoString(arg.base_register_name)
+	}
+	if valid&argumentIndexRegister != 0 {
+		result.indexRegister = C.GoString(arg.index_register_name)
+	}
+	return result.spec()
+}
+
+// spec formats the argument in the assembler syntax of its declaration, with its size
+// (negative if signed) followed by where it's read from
+func (a argument) spec() string {
+	var operand strings.Builder
+	if a.valid&argumentConstant != 0 {
+		fmt.Fprintf(&operand, "$%d", a.constant)
+		return fmt.Sprintf("%d@%s", a.size, operand.String())
+	}
+	if a.valid&argumentDerefIdent != 0 {
+		operand.WriteString(a.derefIdent)
+		if a.valid&argumentDerefOffset != 0 && a.derefOffset != 0 {
+			fmt.Fprintf(&operand, "%+d", a.derefOffset)
+		}
+	} else if a.valid&argumentDerefOffset != 0 {
+		fmt.Fprintf(&operand, "%d", a.derefOffset)
+	}
+	if a.valid&argumentBaseRegister != 0 {
+		base := "%" + a.baseRegister
+		if operand.Len() == 0 && a.valid&argumentIndexRegister == 0 {
+			// The argument is the register itself, rather than memory it points to
+			operand.WriteString(base)
+		} else {
+			operand.WriteString("(" + base)
+			if a.valid&argumentIndexRegister != 0 {
+				operand.WriteString(",%" + a.indexRegister)
+				if a.valid&argumentScale != 0 {
+					fmt.Fprintf(&operand, ",%d", a.scale)
+				}
+			}
+			operand.WriteString(")")
+		}
+	}
+	return fmt.Sprintf("%d@%s", a.size, operand.String())
+}
@@ -0,0 +1,65 @@
+package usdt
+
+import (
+	"testing"
+)
+
+// bccArgument returns the argument the way bcc parses it from its specification
+func bccArgument(a Argument) argument {
+	result := argument{size: a.Size}
+	if a.Signed {
+		result.size = -a.Size
+	}
+	switch a.Kind {
+	case ConstantArgument:
+		result.valid = argumentConstant
+		result.constant = a.Constant
+	case RegisterArgument:
+		result.valid = argumentBaseRegister
+		result.baseRegister = a.Register
+	case MemoryArgument:
+		if a.Offset != 0 {
+			result.valid |= argumentDerefOffset
+			result.derefOffset = int(a.Offset)
+		}
+		if a.Symbol != "" {
+			result.valid |= argumentDerefIdent
+			result.derefIdent = a.Symbol
+		}
+		if a.Register != "" {
+			result.valid |= argumentBaseRegister
+			result.baseRegister = a.Register
+		}
+		if a.Index != "" {
+			result.valid |= argumentIndexRegister | argumentScale
+			result.indexRegister = a.Index
+			result.scale = a.Scale
+		}
+	}
+	return result
+}
+
+func TestArgumentSpec(t *testing.T) {
+	notes, err := ReadNotes("testdata/probes-x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, note := range notes {
+		for _, arg := range note.Arguments {
+			count++
+			// The specification is formatted back the way the fixture declares it
+			if spec := bccArgument(arg).spec(); spec != arg.Spec {
+				t.Errorf("Expected %s, got %s", arg.Spec, spec)
+			}
+		}
+	}
+	if count != 5 {
+		t.Errorf("Expected the fixture to declare 5 arguments, got %d", count)
+	}
+	// A zero offset from a symbol is left out, as bcc flags it either way
+	arg := argument{size: 8, valid: argumentDerefIdent | argumentDerefOffset | argumentBaseRegister, derefIdent: "counter", baseRegister: "rip"}
+	if spec := arg.spec(); spec != "8@counter(%rip)" {
+		t.Errorf("Expected 8@counter(%%rip), got %s", spec)
+	}
+}
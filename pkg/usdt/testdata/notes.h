@@ -0,0 +1,25 @@
+/*
+ * NOTE declares a USDT probe the way sys/sdt.h does, with a .note.stapsdt note holding the
+ * probe's address, the address of .stapsdt.base, its semaphore's address, its provider and
+ * name, and its argument specifications. The specifications are written out rather than
+ * generated from operands, so that the fixtures have the same ones on every architecture.
+ */
+#define NOTE(provider, name, semaphore, args)	\
+1:	nop;					\
+	.pushsection .note.stapsdt, "", "note";	\
+	.balign 4;				\
+	.4byte 3f-2f, 5f-4f, 3;			\
+2:	.asciz "stapsdt";			\
+3:	.balign 4;				\
+4:	.8byte 1b, _.stapsdt.base, semaphore;	\
+	.asciz provider;			\
+	.asciz name;				\
+	.asciz args;				\
+5:	.balign 4;				\
+	.popsection
+
+#define STAPSDT_BASE				\
+	.pushsection .stapsdt.base, "a";	\
+_.stapsdt.base:					\
+	.space 1;				\
+	.popsection
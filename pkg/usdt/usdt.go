@@ -3,20 +3,21 @@ package usdt
 import (
 	"fmt"
 	"github.com/iovisor/gobpf/bcc"
+	"go.uber.org/zap"
 	"strings"
-	"sync"
 	"unsafe"
 )
 
 /*
 #cgo CFLAGS: -I/usr/include/bcc/compat
 #cgo LDFLAGS: -lbcc
+#include <stdlib.h>
 #include <bcc/bcc_common.h>
 #include <bcc/libbpf.h>
 #include <bcc/bcc_usdt.h>
 
 
-void uprobe_cb_gateway (const char *path, const char *fn_name, uint64_t addr, int pid);
+void foreach_uprobe (void *usdt, uintptr_t handle);
 */
 import "C"
 
@@ -41,6 +42,23 @@ func NewContext(pid int) (*Context, error) {
 	}, nil
 }
 
+// NewContextFromPath returns a new usdt context for the binary or library at path, whose probes
+// are attached for every process that runs it. Probes guarded by a semaphore can't be enabled,
+// since there's no process whose semaphore could be set.
+func NewContextFromPath(path string) (*Context, error) {
+	pathCS := C.CString(path)
+	defer C.free(unsafe.Pointer(pathCS))
+	context := C.bcc_usdt_new_frompath(pathCS)
+	if context == nil {
+		return nil, fmt.Errorf("Unable to initialize USDT context for %s", path)
+	}
+	return &Context{
+		Pid:     -1,
+		context: context,
+		closed:  false,
+	}, nil
+}
+
 // Close closes a Context. After this it cannot be used.
 func (c *Context) Close() {
 	if c.closed {
@@ -78,6 +96,20 @@ func (c *Context) AddUSDTArguments(originalCode string) (string, error) {
 	return fullText, nil
 }
 
+// maxArguments is the most arguments a USDT probe can have
+const maxArguments = 12
+
+// ArgumentStubs returns code defining the functions bcc reads the USDT arguments of fnName
+// with, for a probe that isn't enabled, so that fnName still compiles. The stubs fail to
+// read any argument.
+func ArgumentStubs(fnName string) string {
+	var stubs strings.Builder
+	for i := 1; i <= maxArguments; i++ {
+		fmt.Fprintf(&stubs, "static inline int _bpf_readarg_%s_%d(struct pt_regs *ctx, void *dest, size_t len) { return -1; }\n", fnName, i)
+	}
+	return stubs.String()
+}
+
 type uprobeCbArg struct {
 	path   string
 	fnName string
@@ -85,22 +117,40 @@ type uprobeCbArg struct {
 	pid    int
 }
 
-var uprobes []uprobeCbArg
-var uprobeMu sync.Mutex
-
 //export uprobeCb
-func uprobeCb(path, fnName *C.char, addr uint64, pid int) {
-	uprobes = append(uprobes, uprobeCbArg{C.GoString(path), C.GoString(fnName), addr, pid})
+func uprobeCb(h C.uintptr_t, path, fnName *C.char, addr C.uint64_t, pid C.int) {
+	// Panicking would unwind through bcc, so all that can be done with an error is to log it
+	if err := addUprobe(handle(h), uprobeCbArg{C.GoString(path), C.GoString(fnName), uint64(addr), int(pid)}); err != nil {
+		zap.S().Errorf("%s", err)
+	}
+}
+
+// addUprobe adds a uprobe to the uprobes of the enumeration with the handle
+func addUprobe(h handle, uprobe uprobeCbArg) error {
+	uprobes, ok := lookupCallbacks(h).(*[]uprobeCbArg)
+	if !ok {
+		return fmt.Errorf("No uprobe enumeration has handle %d", h)
+	}
+	*uprobes = append(*uprobes, uprobe)
+	return nil
+}
+
+// collectUprobes returns the uprobes reported by the driver's callbacks
+func collectUprobes(driver func(h handle)) []uprobeCbArg {
+	uprobes := []uprobeCbArg{}
+	enumerate(&uprobes, driver)
+	return uprobes
 }
 
 // AttachUprobes attaches uprobes corresponding to enabled USDT probes
 // The module given must be the module containing the enabled probes
 func (c *Context) AttachUprobes(module *bcc.Module) error {
-	// We lock the mutex because we're about to work with the global uprobes array
-	uprobeMu.Lock()
-	defer func() { uprobes = []uprobeCbArg{} }()
-	defer uprobeMu.Unlock()
-	C.bcc_usdt_foreach_uprobe(c.context, (C.bcc_usdt_uprobe_cb)(unsafe.Pointer(C.uprobe_cb_gateway)))
+	if c.closed {
+		return fmt.Errorf("Context is closed")
+	}
+	uprobes := collectUprobes(func(h handle) {
+		C.foreach_uprobe(c.context, C.uintptr_t(h))
+	})
 	for _, probe := range uprobes {
 		fd, err := module.LoadUprobe(probe.fnName)
 		if err != nil {